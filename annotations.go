@@ -0,0 +1,53 @@
+package backup
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/GrantStreetGroup/go-exasol-client"
+)
+
+// Objects can opt in or out of backups via annotations in their comments.
+// "@backup:skip" in a schema, table or script comment skips it (and for a
+// schema everything in it) as if it matched Skip. "@backup:data" in a table
+// comment backs up its data regardless of the data limits as if it
+// matched DataMatch. The files of skipped objects are left as they are.
+
+const (
+	skipAnnotation = "@backup:skip"
+	dataAnnotation = "@backup:data"
+)
+
+var annotationRegexp = regexp.MustCompile(`(?i)@backup:([a-z]+)\b`)
+
+// This returns true if the comment contains the annotation
+func hasAnnotation(comment, annotation string) bool {
+	for _, m := range annotationRegexp.FindAllString(comment, -1) {
+		if strings.EqualFold(m, annotation) {
+			return true
+		}
+	}
+	return false
+}
+
+// This returns the schemas whose comments annotate them to be skipped
+func getSkippedSchemas(conn *exasol.Conn) (map[string]bool, error) {
+	sql := `
+		SELECT schema_name, schema_comment
+		FROM exa_schemas
+		WHERE UPPER(schema_comment) LIKE '%@BACKUP:SKIP%'
+	`
+	res, err := conn.FetchSlice(sql)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to get skipped schemas: %s", err)
+	}
+	skipped := map[string]bool{}
+	for _, row := range res {
+		if hasAnnotation(row[1].(string), skipAnnotation) {
+			log.Infof("Skipping schema %s as it's annotated with %s", row[0], skipAnnotation)
+			skipped[row[0].(string)] = true
+		}
+	}
+	return skipped, nil
+}
@@ -11,7 +11,10 @@ import (
 	"os"
 	"path/filepath"
 	"regexp"
+	"sort"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/GrantStreetGroup/go-exasol-client"
 	"github.com/sirupsen/logrus"
@@ -37,8 +40,21 @@ const (
 	VIEWS
 )
 
+// DDLMode determines how the table DDL is written
+type DDLMode byte
+
+const (
+	// Tables are recreated, dropping any existing data
+	CREATE_OR_REPLACE DDLMode = iota
+	// Tables are only created if they don't exist. The constraints,
+	// distribution, partitioning and comments of existing tables
+	// are then brought in line using idempotent statements.
+	CREATE_IF_NOT_EXISTS
+)
+
 type Conf struct {
-	// Exasol instance to backup from
+	// Exasol instance to backup from. Its autocommit mode and
+	// session settings are restored once the backup returns.
 	Source *exasol.Conn
 	// Local filesystem directory underwhich to store the backup
 	Destination string
@@ -50,8 +66,11 @@ type Conf struct {
 	// Each pattern should be in the form of "schema.object".
 	// If the object is not specified "schema.*" is assumed.
 	// If the schema not specified then "*.*" is assumed.
+	// Names containing dots, commas or asterisks can be double quoted e.g.
+	// "my.schema".* or have those characters escaped with a "\".
 	// Non-schema objects (users, roles, connections, parameters) are
 	// not affected by this config. i.e. they will be backup all-or-none
+	// unless they have TypeCriteria of their own.
 	Match string
 	// Skip is the inverse of Match.
 	// Any schema objects matching it will be skipped.
@@ -60,35 +79,212 @@ type Conf struct {
 	// should be interpreted as regular expressions. If true then
 	// it will be evaluated against each "schema.object" string in the database.
 	RegexpMatch bool
+	// Owner is a comma delimited set of wildcard patterns. If set then
+	// only the schema objects owned by a matching user or role are backed up.
+	Owner string
+	// If set then only the schema objects changed (i.e. whose LAST_COMMIT is)
+	// since then are backed up. It's converted to the session's time zone,
+	// which LAST_COMMIT is in.
+	ModifiedSince time.Time
+	// If true then ModifiedSince defaults to the time at which the previous
+	// backup to the Destination started reading the catalog. This assumes
+	// the previous backup covered the same objects.
+	Incremental bool
+	// The files of objects filtered out by the above three are left as they are.
+
+	// CriteriaFile is the path to a file of Match and Skip patterns, one
+	// per line, used instead of the three configs above. See criteria_file.go
+	CriteriaFile string
+
+	// TableDDL determines how the table DDL is written.
+	// Defaults to CREATE_OR_REPLACE. Use CREATE_IF_NOT_EXISTS for
+	// table files that can be safely run against a populated database.
+	TableDDL DDLMode
+
+	// TypeCriteria overrides Match and Skip for the given object types
+	// e.g. to backup all views but only the tables in "STAGE_*" schemas.
+	// For USERS, ROLES, CONNECTIONS and CONSUMER_GROUPS (or PRIORITY_GROUPS)
+	// the patterns are plain wildcard names e.g. "TENANT1_*" and DropExtras
+	// only removes the files of those matching them. The entries of
+	// connections and groups not matching them are kept in their files.
+	TypeCriteria map[Object]TypeCriteria
+	// DataMatch is a comma delimited set of "schema.object" wildcard
+	// patterns. The tables and views matching it have their data backed
+	// up regardless of MaxTableRows, MaxViewRows and the byte limits.
+	DataMatch string
 
 	// If > 0 then tables with this many or fewer rows
 	// will have the their data backed up to CSV files.
-	// If 0 then no table data will be backed up.
+	// If 0 then no table data will be backed up
+	// unless one of the byte limits below is set.
 	MaxTableRows int
 	// If > 0 then views with this many or fewer rows
 	// will have the their data backed up to CSV files.
 	// If 0 then no view data will be backed up.
 	MaxViewRows int
+	// If > 0 then only tables whose raw (uncompressed) size is this
+	// many bytes or fewer will have their data backed up.
+	// It can be combined with MaxTableRows in which case a table's data
+	// is only backed up if it falls within both limits.
+	MaxTableBytes int64
+	// Like MaxTableBytes but compared against the compressed size
+	// of the table as reported by Exasol.
+	MaxTableCompressedBytes int64
+	// If > 0 then tables exceeding the above limits will have this many
+	// of their rows backed up to a "<table>.sample.csv" file instead.
+	// The sample is deterministic and sampled rows of tables referencing
+	// other sampled tables only reference rows included in those samples.
+	SampleRows int
+	// Like SampleRows but as a percentage of the table's rows.
+	// If both are set then the smaller sample is taken.
+	SamplePercent float64
+	// If true then table data is only re-exported if it has changed since
+	// the previous backup. This is determined by comparing a fingerprint,
+	// based on Exasol's last commit to the table, its (filtered) row count
+	// and the export settings, with the one recorded in the previous manifest.
+	// A RowFilters predicate using the current time, e.g.
+	// created > ADD_DAYS(CURRENT_DATE, -30), or other non-deterministic
+	// functions can select different rows of an unchanged table so such
+	// tables are always re-exported.
+	SkipUnchangedData bool
+	// If true then tables with a RowFilters predicate are always
+	// re-exported even with SkipUnchangedData.
+	ReexportFilteredData bool
+
+	// CSVFormat is the CSV dialect used for table and view data files.
+	// Any fields left unset use Exasol's EXPORT defaults.
+	CSVFormat CSVFormat
+	// CSVFormats overrides CSVFormat for the tables and views matching
+	// each "schema.object" wildcard pattern. Unset fields fall back
+	// to CSVFormat. If several patterns match the longest one wins.
+	CSVFormats map[string]CSVFormat
+
+	// RowFilters maps "schema.table" wildcard patterns to SQL predicates.
+	// Only the rows of matching tables satisfying the predicate
+	// (e.g. "created_at > ADD_DAYS(CURRENT_DATE, -90)") are backed up
+	// and MaxTableRows is compared against the filtered row count.
+	// If several patterns match the longest one wins.
+	RowFilters map[string]string
+
+	// Masks maps "schema.object.column" wildcard patterns to the masking
+	// applied to matching table and view columns as their data is exported.
+	// If several patterns match the longest one wins.
+	Masks map[string]Mask
+
+	// If true then the whole run reads the catalog from a consistent
+	// snapshot by using Exasol's system table snapshot mode within a single
+	// read transaction. The transaction is recorded in the manifest.
+	Snapshot bool
 
 	// If true then any text files existing in the destination
 	// but no longer existing in Exasol will be removed.
 	// If false then the backup is purely additive
 	DropExtras bool
+	// These guard against DropExtras removing most of the backup.
+	// If more than MaxDrops files, or more than MaxDropPercent percent of
+	// the existing files, of an object type would be removed then nothing
+	// is removed and an error is returned instead. The data files removed as
+	// they're no longer backed up, and the per-schema foreign key and identity
+	// files left empty, are counted separately as they're found.
+	// A limit of 0 is unlimited but if neither is set then MaxDropPercent
+	// defaults to 50.
+	MaxDrops       int
+	MaxDropPercent float64 // Drops of 10 files or fewer are always within it
+	// If true then the above limits are ignored
+	ForceDrops bool
+	// If true then the files DropExtras would remove are instead moved
+	// under a dated "_dropped/<timestamp>/" directory in the Destination,
+	// keeping their relative path, so that they can still be recovered.
+	QuarantineDrops bool
+	// If > 0 then quarantined files are removed after this many days
+	QuarantineDays int
+
+	// Only one backup at a time can write to a Destination. If it's locked
+	// by another backup then this is how long to wait for it to finish
+	// before giving up. If 0 then an error is returned immediately.
+	LockTimeout time.Duration
+	// If > 0 then a lock taken longer than this ago is considered stale
+	// and is taken over. Locks held by processes that no longer exist on
+	// this host are always considered stale.
+	StaleLockAge time.Duration
+
+	// If true then nothing is written to the Destination. Instead the
+	// files that would be created, modified or removed are logged (as
+	// warnings so that they're logged by default). See DryRun() for
+	// getting them as a list instead.
+	DryRun bool
 
 	LogLevel string // Defaults to "warning"
 }
 
+// TypeCriteria are the Match and Skip patterns of an object type (see Conf)
+type TypeCriteria struct {
+	Match string // Defaults to "*.*"
+	Skip  string
+}
+
+// DataConf controls which table or view data is backed up and how
+type DataConf struct {
+	// See Conf.MaxTableRows and Conf.MaxViewRows
+	MaxRows int
+	// See Conf.MaxTableBytes and Conf.MaxTableCompressedBytes
+	MaxBytes           int64
+	MaxCompressedBytes int64
+	// See Conf.SampleRows and Conf.SamplePercent
+	SampleRows    int
+	SamplePercent float64
+	// See Conf.SkipUnchangedData and Conf.ReexportFilteredData
+	SkipUnchanged    bool
+	ReexportFiltered bool
+	// See Conf.CSVFormat and Conf.CSVFormats
+	CSVFormat  CSVFormat
+	CSVFormats map[string]CSVFormat
+	// See Conf.RowFilters
+	RowFilters map[string]string
+	// See Conf.Masks
+	Masks map[string]Mask
+	// See Conf.DataMatch
+	Match string
+}
+
 func Backup(cfg Conf) error {
-	err := initLogging(cfg.LogLevel)
+	if cfg.DryRun {
+		changes, err := DryRun(cfg)
+		for _, c := range changes {
+			log.Warningf("Dry run: %s", c)
+		}
+		return err
+	}
+	return runBackup(cfg, nil)
+}
+
+// DryRun runs all of the catalog queries of a backup with the given config
+// but writes nothing to the Destination. Instead it returns the files which
+// would be created, modified or removed along with the reason for each.
+func DryRun(cfg Conf) ([]FileChange, error) {
+	dryRun := newDryRun(cfg.Destination)
+	err := runBackup(cfg, dryRun)
+	return dryRun.changes(), err
+}
+
+func runBackup(cfg Conf, dryRun *dryRun) (err error) {
+	err = initLogging(cfg.LogLevel)
 	if err != nil {
 		return err
 	}
 	log.Infof("Backing up to %s", cfg.Destination)
 
-	// Set defaults
-	if cfg.Match == "" {
-		cfg.Match = "*.*"
+	run := &backupRun{dryRun: dryRun}
+	critFor, globalCritFor, err := configCriteria(cfg, run)
+	if err != nil {
+		return err
 	}
+	err = validateMasks(cfg.Masks)
+	if err != nil {
+		return err
+	}
+
+	// Set defaults
 	if cfg.Source == nil {
 		return errors.New("You must specify a source Exasol connection")
 	}
@@ -100,6 +296,14 @@ func Backup(cfg Conf) error {
 		return errors.New("The Destination must be a valid directory path")
 	}
 
+	if dryRun == nil {
+		lock, err := lockDestination(cfg.Destination, cfg.LockTimeout, cfg.StaleLockAge)
+		if err != nil {
+			return err
+		}
+		defer lock.release()
+	}
+
 	backup := map[Object]bool{}
 	for _, o := range cfg.Objects {
 		backup[o] = true
@@ -107,93 +311,241 @@ func Backup(cfg Conf) error {
 	src := cfg.Source
 	dst := cfg.Destination
 	drop := cfg.DropExtras
-	crit := Criteria{cfg.Match, cfg.Skip, cfg.RegexpMatch, src}
+	tableData := DataConf{
+		MaxRows:    cfg.MaxTableRows,
+		CSVFormat:  cfg.CSVFormat,
+		CSVFormats: cfg.CSVFormats,
+		Masks:      cfg.Masks,
+		Match:      cfg.DataMatch,
+	}
+	viewData := tableData
+	viewData.MaxRows = cfg.MaxViewRows
+	tableData.MaxBytes = cfg.MaxTableBytes
+	tableData.MaxCompressedBytes = cfg.MaxTableCompressedBytes
+	tableData.SampleRows = cfg.SampleRows
+	tableData.SamplePercent = cfg.SamplePercent
+	tableData.SkipUnchanged = cfg.SkipUnchangedData
+	tableData.ReexportFiltered = cfg.ReexportFilteredData
+	tableData.RowFilters = cfg.RowFilters
 
-	// TODO capture and restore original values of these 2 settings
+	run.manifest, err = loadManifest(dst)
+	if err != nil {
+		return err
+	}
+	run.dropLimit = newDropLimit(cfg)
+	run.regexpCache = newRegexpCache()
+	if cfg.QuarantineDrops {
+		run.quarantine = newQuarantine(dst)
+		run.quarantine.expire(run, cfg.QuarantineDays)
+	}
+
+	// The caller may go on using the connection so the
+	// session is put back the way it was found however we exit.
+	params := []string{"NLS_TIMESTAMP_FORMAT"}
+	if cfg.Snapshot {
+		params = append(params, "SNAPSHOT_MODE")
+	}
+	session, err := saveSession(src, params...)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		restoreErr := session.restore(src)
+		if err == nil {
+			err = restoreErr
+		} else if restoreErr != nil {
+			log.Error(restoreErr)
+		}
+	}()
 	src.DisableAutoCommit()
 	src.Execute("ALTER SESSION SET NLS_TIMESTAMP_FORMAT='YYYY-MM-DD HH24:MI:SS.FF3'")
 	setCapabilities(src)
 
+	if cfg.Snapshot {
+		_, err = src.Execute("ALTER SESSION SET SNAPSHOT_MODE='SYSTEM TABLES'")
+		if err != nil {
+			return fmt.Errorf("Unable to enable snapshot mode: %s", err)
+		}
+		err = run.manifest.recordSnapshot(src)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = run.manifest.recordCatalogTime(src)
+	if err != nil {
+		return err
+	}
+	run.objectFilter = newObjectFilter(cfg.Owner, modifiedSince(cfg, run.manifest))
+
+	if tableData.enabled() || viewData.enabled() {
+		err = run.manifest.recordSession(src)
+		if err != nil {
+			return err
+		}
+	}
+
 	if backup[PARAMETERS] || backup[ALL] {
-		err := BackupParameters(src, dst)
+		err := BackupParameters(src, dst, run)
 		if err != nil {
 			return err
 		}
 	}
 	if backup[PRIORITY_GROUPS] || backup[CONSUMER_GROUPS] || backup[ALL] {
 		if capability.consumerGroups {
-			err = BackupConsumerGroups(src, dst)
+			err = BackupConsumerGroups(src, dst, globalCritFor(CONSUMER_GROUPS))
 		} else {
-			err = BackupPriorityGroups(src, dst)
+			err = BackupPriorityGroups(src, dst, globalCritFor(PRIORITY_GROUPS))
 		}
 		if err != nil {
 			return err
 		}
 	}
 	if backup[SCHEMAS] || backup[ALL] {
-		err := BackupSchemas(src, dst, crit, drop)
+		err := BackupSchemas(src, dst, critFor(SCHEMAS), drop)
 		if err != nil {
 			return err
 		}
 	}
 	if backup[VIRTUAL_SCHEMAS] || backup[ALL] {
-		err := BackupVirtualSchemas(src, dst, crit, drop)
+		err := BackupVirtualSchemas(src, dst, critFor(VIRTUAL_SCHEMAS), drop)
 		if err != nil {
 			return err
 		}
 	}
 	if backup[TABLES] || backup[ALL] {
-		err := BackupTables(src, dst, crit, cfg.MaxTableRows, drop)
+		err := BackupTables(src, dst, critFor(TABLES), tableData, cfg.TableDDL, drop)
 		if err != nil {
 			return err
 		}
 	}
 	if backup[VIEWS] || backup[ALL] {
-		err := BackupViews(src, dst, crit, cfg.MaxViewRows, drop)
+		err := BackupViews(src, dst, critFor(VIEWS), viewData, drop)
 		if err != nil {
 			return err
 		}
 	}
 	if backup[SCRIPTS] || backup[ALL] {
-		err := BackupScripts(src, dst, crit, drop)
+		err := BackupScripts(src, dst, critFor(SCRIPTS), drop)
 		if err != nil {
 			return err
 		}
 	}
 	if backup[FUNCTIONS] || backup[ALL] {
-		err := BackupFunctions(src, dst, crit, drop)
+		err := BackupFunctions(src, dst, critFor(FUNCTIONS), drop)
 		if err != nil {
 			return err
 		}
 	}
 	if backup[CONNECTIONS] || backup[ALL] {
-		err := BackupConnections(src, dst)
+		err := BackupConnections(src, dst, globalCritFor(CONNECTIONS))
 		if err != nil {
 			return err
 		}
 	}
 	if backup[ROLES] || backup[ALL] {
-		err := BackupRoles(src, dst, drop)
+		err := BackupRoles(src, dst, globalCritFor(ROLES), drop)
 		if err != nil {
 			return err
 		}
 	}
 	if backup[USERS] || backup[ALL] {
-		err := BackupUsers(src, dst, drop)
+		err := BackupUsers(src, dst, globalCritFor(USERS), drop)
 		if err != nil {
 			return err
 		}
 	}
 
+	err = run.manifest.write(run, dst)
+	if err != nil {
+		return err
+	}
+
 	log.Info("Done backing up")
 	return nil
 }
 
+// This returns the criteria of each type of schema object (critFor)
+// and of each type of global object (globalCritFor) given by the config.
+func configCriteria(cfg Conf, run *backupRun) (critFor, globalCritFor func(Object) Criteria, err error) {
+	var rules []CriteriaRule // The CriteriaFile's
+	if cfg.CriteriaFile != "" {
+		if cfg.Match != "" || cfg.Skip != "" || cfg.RegexpMatch {
+			return nil, nil, errors.New("CriteriaFile can't be combined with Match, Skip or RegexpMatch")
+		}
+		cf, err := ReadCriteriaFile(cfg.CriteriaFile)
+		if err != nil {
+			return nil, nil, err
+		}
+		rules = cf.Rules
+	}
+
+	err = validatePatterns(cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+	if cfg.Match == "" && rules == nil {
+		cfg.Match = "*.*"
+	}
+
+	src := cfg.Source
+	crit := Criteria{
+		match:       cfg.Match,
+		skip:        cfg.Skip,
+		regexpMatch: cfg.RegexpMatch,
+		rules:       rules,
+		exaConn:     src,
+		run:         run,
+	}
+	critFor = func(o Object) Criteria {
+		tc, ok := cfg.TypeCriteria[o]
+		if !ok {
+			return crit
+		}
+		if tc.Match == "" {
+			tc.Match = "*.*"
+		}
+		return Criteria{match: tc.Match, skip: tc.Skip, regexpMatch: cfg.RegexpMatch, exaConn: src, run: run}
+	}
+	// Global objects are all backed up unless there are criteria for their type
+	globalCritFor = func(o Object) Criteria {
+		tc := cfg.TypeCriteria[o]
+		if tc.Match == "" {
+			tc.Match = "*"
+		}
+		return Criteria{match: tc.Match, skip: tc.Skip, exaConn: src, run: run}
+	}
+	return critFor, globalCritFor, nil
+}
+
+// This returns the SQL of the time schema objects must have
+// changed since to be backed up, or "" if they all are.
+func modifiedSince(cfg Conf, m *manifest) string {
+	if !cfg.ModifiedSince.IsZero() {
+		return fmt.Sprintf(
+			"CONVERT_TZ(TO_TIMESTAMP('%s', '%s'), 'UTC', SESSIONTIMEZONE)",
+			cfg.ModifiedSince.UTC().Format("2006-01-02 15:04:05.000"), catalogTimeFormat,
+		)
+	}
+	if !cfg.Incremental {
+		return ""
+	}
+	since := m.previousCatalogTime()
+	if since == "" {
+		log.Warning("No previous backup to be incremental to so backing up everything")
+		return ""
+	}
+	return fmt.Sprintf("TO_TIMESTAMP('%s', '%s')", qStr(since), catalogTimeFormat)
+}
+
 type Criteria struct {
 	match       string
 	skip        string
 	regexpMatch bool
-	exaConn     *exasol.Conn
+	// A CriteriaFile's rules, which are used instead of match and skip
+	rules   []CriteriaRule
+	exaConn *exasol.Conn
+	run     *backupRun // nil outside of a backup
 }
 
 /* Private routines */
@@ -226,6 +578,9 @@ func initLogging(logLevelStr string) error {
 }
 
 func (c *Criteria) getSQLCriteria() string {
+	if c.rules != nil {
+		return c.rulesSQL()
+	}
 	whereClause := buildCriteria(c.match, c.regexpMatch)
 	if c.skip != "" {
 		whereClause = fmt.Sprintf(
@@ -236,60 +591,92 @@ func (c *Criteria) getSQLCriteria() string {
 	return whereClause
 }
 
+// This returns the SQL of the rules where the last one matching decides
+func (c *Criteria) rulesSQL() string {
+	sql := "CASE"
+	for i := len(c.rules) - 1; i >= 0; i-- {
+		r := c.rules[i]
+		sql += fmt.Sprintf(" WHEN %s THEN %t", buildCriteria(r.Pattern, r.Regexp), !r.Skip)
+	}
+	return sql + " ELSE FALSE END"
+}
+
 func (c *Criteria) matches(schema, object string) bool {
-	return matchesCriteria(c.match, schema, object, c.regexpMatch, false, c.exaConn) &&
-		(c.skip == "" || !matchesCriteria(c.skip, schema, object, c.regexpMatch, true, c.exaConn))
+	cache := c.state().regexpCache
+	if c.rules != nil {
+		for i := len(c.rules) - 1; i >= 0; i-- {
+			r := c.rules[i]
+			if matchesCriteria(r.Pattern, schema, object, r.Regexp, r.Skip, c.exaConn, cache) {
+				return !r.Skip
+			}
+		}
+		return false
+	}
+	return matchesCriteria(c.match, schema, object, c.regexpMatch, false, c.exaConn, cache) &&
+		(c.skip == "" || !matchesCriteria(c.skip, schema, object, c.regexpMatch, true, c.exaConn, cache))
+}
+
+// This returns the run the criteria belong to or,
+// if they're used outside of a backup, an empty one.
+func (c *Criteria) state() *backupRun {
+	if c.run == nil {
+		return &backupRun{}
+	}
+	return c.run
 }
 
 func matchesCriteria(
 	matchStr, schema, object string,
 	regexpMatch, skipping bool,
 	exaConn *exasol.Conn,
+	cache *regexpCache,
 ) bool {
 
 	if regexpMatch {
 		// Go doesn't support negative lookahead regexps while Exasol does so
-		// we run the comparison in Exasol.
-		res, err := exaConn.FetchSlice(fmt.Sprintf(
-			`SELECT '%s.%s' REGEXP_LIKE '(?i)^%s$'`,
-			qStr(schema), qStr(object), qStr(matchStr),
-		))
+		// we run the comparison in Exasol (see regexp_cache.go).
+		name := schema + "." + object
+		if matched, ok := cache.get(matchStr, name); ok {
+			return matched
+		}
+		res, err := fetchRegexpMatches(exaConn, []string{matchStr}, []string{name})
 		if err != nil {
-			log.Errorf("Unable to match regexp: %s", err)
+			log.Error(err)
 			return false
 		}
-		return res[0][0].(bool)
+		matched := res[0][1] == true
+		cache.set(matchStr, name, matched)
+		return matched
 	}
 
-	// Convert wildcards to regexp wildcard match
-	for _, match := range strings.Split(matchStr, ",") {
-		parts := strings.Split(match, ".")
-		var schemaPattern = regexp.MustCompile(`\*`).ReplaceAllString(parts[0], ".*")
-		var objectPattern string
-		if len(parts) > 1 {
-			objectPattern = regexp.MustCompile(`\*`).ReplaceAllString(parts[1], ".*")
-		} else {
-			objectPattern = ".*"
-		}
-		if regexp.MustCompile("(?i)^" + schemaPattern + "$").MatchString(schema) {
-			if object == "" {
-				// if the object is "" it means where just checking if the schema
-				// as a whole should be matched or not.
-				if skipping == true {
-					// If we're checking a negative-match (skipping) criteria
-					// then we want to match (i.e skip) the schema
-					// if all objects are matched (i.e. skipped).
-					return objectPattern == ".*"
-				} else {
-					// If we're checking a positive-match (non-skip) criteria
-					// then we want to match the schema if *any* object
-					// is matched by the criteria and this is always the case.
-					return true
-				}
+	patterns, err := parsePatterns(matchStr, 2)
+	if err != nil {
+		log.Error(err)
+		return false
+	}
+	for _, p := range patterns {
+		if !p.matches(schema) {
+			continue
+		}
+		if object == "" {
+			// if the object is "" it means where just checking if the schema
+			// as a whole should be matched or not.
+			if !skipping {
+				// If we're checking a positive-match (non-skip) criteria
+				// then we want to match the schema if *any* object
+				// is matched by the criteria and this is always the case.
+				return true
 			}
-			if regexp.MustCompile("(?i)^" + objectPattern + "$").MatchString(object) {
+			// If we're checking a negative-match (skipping) criteria
+			// then we want to match (i.e skip) the schema
+			// if all objects are matched (i.e. skipped).
+			if p.name(1).matchesAll() {
 				return true
 			}
+			continue
+		}
+		if p.matches(schema, object) {
+			return true
 		}
 	}
 	return false
@@ -297,49 +684,68 @@ func matchesCriteria(
 
 func buildCriteria(argStr string, regexpMatch bool) string {
 	if regexpMatch {
-		return fmt.Sprintf(`( CONCAT(local.s,'.',local.o) REGEXP_LIKE '(?i)%s' )`, qStr(argStr))
+		return fmt.Sprintf(`( CONCAT(local.s,'.',local.o) REGEXP_LIKE %s )`, regexpSQL(argStr))
 	}
 
 	// Otherwise convert wildcards to SQL wildcard match
-	arg := regexp.MustCompile(`\*`).ReplaceAllString(argStr, "%")
+	patterns, err := parsePatterns(argStr, 2)
+	if err != nil {
+		// The patterns are checked up front so this shouldn't happen
+		log.Error(err)
+		return "FALSE"
+	}
 	var whereClause []string
-	for _, st := range strings.Split(arg, ",") {
-		parts := strings.Split(st, ".")
-		var schema = parts[0]
-		var object string
-		if len(parts) > 1 {
-			object = parts[1]
-		} else {
-			object = "%"
-		}
+	for _, p := range patterns {
 		criteria := fmt.Sprintf(`(
-				UPPER(local.s) LIKE UPPER('%s') AND
-				UPPER(local.o) LIKE UPPER('%s')
-			)`, qStr(schema), qStr(object),
+				%s AND
+				%s
+			)`, p.name(0).sql("local.s"), p.name(1).sql("local.o"),
 		)
 		whereClause = append(whereClause, criteria)
 	}
 	return strings.Join(whereClause, " OR ")
 }
 
-func removeExtraObjects(objType string, srcObjs []dbObj, dst string, crit Criteria) {
+func removeExtraObjects(objType string, srcObjs []dbObj, dst string, crit Criteria) error {
 	log.Infof("Removing extraneous %s", objType)
+	run := crit.state()
 
 	schemaDir := filepath.Join(dst, "schemas")
-	os.MkdirAll(schemaDir, os.ModePerm) // May be the first time we're backing up the env
+	run.makeDir(schemaDir) // May be the first time we're backing up the env
 
 	dstSchemas, err := ioutil.ReadDir(schemaDir)
 	if err != nil {
 		// If this is the first time we're backing up the environment
 		// there may be no directory to read yet.
 		log.Warning(err)
-		return
+		return nil
 	}
 
+	if crit.regexpMatch {
+		var names [][2]string
+		for _, dstSchema := range dstSchemas {
+			names = append(names, [2]string{dstSchema.Name(), ""})
+			if objType != "schemas" {
+				objs, _ := ioutil.ReadDir(filepath.Join(schemaDir, dstSchema.Name(), objType))
+				for _, obj := range objs {
+					names = append(names, [2]string{dstSchema.Name(), objectFileBaseName(obj.Name())})
+				}
+			}
+		}
+		crit.prefetch(names)
+	}
+
+	// The extraneous files are all found before any are removed
+	// so that the drop limits can be checked up front.
+	var extras []string
+	var existing, removing int
+
 SCHEMA:
 	for _, dstSchema := range dstSchemas {
 		if dstSchema.IsDir() && crit.matches(dstSchema.Name(), "") {
 			if objType == "schemas" {
+				fileCount := countFiles(filepath.Join(schemaDir, dstSchema.Name()))
+				existing += fileCount
 				for _, srcObj := range srcObjs {
 					// Check if existing destination schema still exists
 					// in the source. If not we'll remove it
@@ -347,7 +753,8 @@ SCHEMA:
 						continue SCHEMA
 					}
 				}
-				os.RemoveAll(filepath.Join(schemaDir, dstSchema.Name()))
+				extras = append(extras, filepath.Join(schemaDir, dstSchema.Name()))
+				removing += fileCount
 
 			} else { // Non-Schema objects
 				objDir := filepath.Join(schemaDir, dstSchema.Name(), objType)
@@ -358,8 +765,9 @@ SCHEMA:
 				}
 			OBJ:
 				for _, obj := range objs {
-					objBaseName := strings.TrimSuffix(obj.Name(), filepath.Ext(obj.Name()))
+					objBaseName := objectFileBaseName(obj.Name())
 					if crit.matches(dstSchema.Name(), objBaseName) {
+						existing++
 						for _, srcObj := range srcObjs {
 							// Check if existing destination object still exists
 							// in the source. If not we'll remove it
@@ -368,13 +776,257 @@ SCHEMA:
 								continue OBJ
 							}
 						}
-						log.Infof("Dropping %s.%s %s", dstSchema.Name(), objBaseName, objType)
-						os.Remove(filepath.Join(objDir, obj.Name()))
+						extras = append(extras, filepath.Join(objDir, obj.Name()))
+						removing++
 					}
 				}
 			}
 		}
 	}
+
+	err = run.dropLimit.check(objType, removing, existing)
+	if err != nil {
+		return err
+	}
+	for _, fp := range extras {
+		log.Infof("Dropping %s", fp)
+		err = run.quarantine.remove(run, fp, objType, "no longer exists in Exasol")
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// This removes the files in the directory belonging to objects within the
+// criteria other than the given ones. Each object has a "<name>.sql" file.
+func removeExtraFiles(objType, dir string, names []string, crit Criteria) error {
+	log.Infof("Removing extraneous backedup %s", objType)
+	run := crit.state()
+
+	current := map[string]bool{}
+	for _, name := range names {
+		current[name+".sql"] = true
+	}
+	files, _ := ioutil.ReadDir(dir)
+	var extras []string
+	existing := 0
+	for _, f := range files {
+		if !crit.matches(objectFileBaseName(f.Name()), "") {
+			continue
+		}
+		existing++
+		if !current[f.Name()] {
+			extras = append(extras, filepath.Join(dir, f.Name()))
+		}
+	}
+
+	err := run.dropLimit.check(objType, len(extras), existing)
+	if err != nil {
+		return err
+	}
+	for _, fp := range extras {
+		log.Infof("Dropping %s", fp)
+		err = run.quarantine.remove(run, fp, objType, "no longer exists in Exasol")
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// This guards against DropExtras removing most of the backup due to e.g.
+// a wrong Match pattern or a catalog query unexpectedly returning no rows.
+type dropLimit struct {
+	maxCount   int
+	maxPercent float64
+	force      bool
+	// The files of each kind (see droppedFiles) existing before
+	// the backup and how many of them have been dropped so far
+	files   map[string]int
+	dropped map[string]int
+	mux     sync.Mutex
+}
+
+// If neither MaxDrops nor MaxDropPercent is set then
+// no more than this percentage of the files are dropped
+const defaultMaxDropPercent = 50
+
+// Dropping this many files or fewer is always within MaxDropPercent
+// so as not to get in the way of small backups
+const minPercentDrops = 10
+
+// The files which are dropped one at a time, as they're found, rather than
+// by removeExtraObjects. Each kind's files are found by the glob pattern.
+var droppedFiles = map[string]string{
+	"tables data":  "schemas/*/tables/*.csv",
+	"views data":   "schemas/*/views/*.csv",
+	"foreign keys": "schemas/*/" + foreignKeysFile,
+	"identities":   "schemas/*/" + identitiesFile,
+}
+
+func newDropLimit(cfg Conf) *dropLimit {
+	l := &dropLimit{
+		maxCount:   cfg.MaxDrops,
+		maxPercent: cfg.MaxDropPercent,
+		force:      cfg.ForceDrops,
+		files:      map[string]int{},
+		dropped:    map[string]int{},
+	}
+	if l.maxCount == 0 && l.maxPercent == 0 {
+		l.maxPercent = defaultMaxDropPercent
+	}
+	if cfg.DropExtras && !cfg.ForceDrops {
+		for kind, pattern := range droppedFiles {
+			files, _ := filepath.Glob(filepath.Join(cfg.Destination, filepath.FromSlash(pattern)))
+			l.files[kind] = len(files)
+		}
+	}
+	return l
+}
+
+// This returns an error if removing this many of the existing
+// files of the given object type exceeds the limits.
+func (l *dropLimit) check(objType string, removing, existing int) error {
+	if l == nil || l.force || removing == 0 {
+		return nil
+	}
+	if l.maxCount > 0 && removing > l.maxCount {
+		return fmt.Errorf(
+			"Refusing to drop %d extraneous %s files which exceeds MaxDrops of %d. "+
+				"Set ForceDrops to drop them anyway",
+			removing, objType, l.maxCount,
+		)
+	}
+	pct := float64(removing) * 100 / float64(existing)
+	if l.maxPercent > 0 && removing > minPercentDrops && pct > l.maxPercent {
+		return fmt.Errorf(
+			"Refusing to drop %d of %d %s files (%0.f%%) which exceeds MaxDropPercent of %0.f%%. "+
+				"Set ForceDrops to drop them anyway",
+			removing, existing, objType, pct, l.maxPercent,
+		)
+	}
+	return nil
+}
+
+// This counts one more file of the given kind (see droppedFiles) being
+// dropped against the limits. Unlike the files of extraneous objects these
+// are only found as the objects are backed up so they're compared with the
+// files of the kind existing before the backup.
+func (l *dropLimit) drop(kind string) error {
+	if l == nil || l.force {
+		return nil
+	}
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	removing := l.dropped[kind] + 1
+	existing := l.files[kind]
+	if existing < removing {
+		existing = removing // It was written by this backup
+	}
+	err := l.check(kind, removing, existing)
+	if err != nil {
+		return err
+	}
+	l.dropped[kind] = removing
+	return nil
+}
+
+// This returns the number of files under the given path
+func countFiles(path string) int {
+	count := 0
+	filepath.Walk(path, func(_ string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			count++
+		}
+		return nil
+	})
+	return count
+}
+
+// The data files an object may have other than its DDL
+var dataFileExts = []string{".csv", ".sample.csv"}
+
+// This removes any data files of the object other than the current one (if any).
+// If dropExtras is false they are instead renamed with a ".stale" suffix
+// so that nothing is lost but they're no longer picked up by a restore.
+func retireDataFiles(dir, objName, current string, dropExtras bool, run *backupRun) error {
+	for _, ext := range dataFileExts {
+		fileName := objName + ext
+		if fileName == current {
+			continue
+		}
+		fp := filepath.Join(dir, fileName)
+		if _, err := os.Stat(fp); err != nil {
+			continue
+		}
+		if dropExtras {
+			// dir is the object type's directory e.g. "schemas/<schema>/tables"
+			err := run.dropLimit.drop(filepath.Base(dir) + " data")
+			if err != nil {
+				return err
+			}
+			log.Infof("Removing stale data file %s", fp)
+			err = run.quarantine.remove(run, fp, "data", "stale data")
+			if err != nil {
+				return fmt.Errorf("Unable to remove stale data file %s: %s", fp, err)
+			}
+		} else {
+			log.Infof("Marking data file %s as stale", fp)
+			err := run.renamePath(fp, fp+".stale", "data", "stale data")
+			if err != nil {
+				return fmt.Errorf("Unable to mark data file %s as stale: %s", fp, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Connections, consumer groups and priority groups are each backed up to a
+// single file. So that a Destination can be shared by backups with different
+// TypeCriteria the file's entries of objects outside of the criteria are
+// kept. Each entry starts with a line matching start whose first submatch is
+// the object's name. entries holds the SQL of each object being backed up.
+func writeObjectsFile(fp, objType string, start *regexp.Regexp, entries map[string]string, crit Criteria) error {
+	all := map[string]string{}
+	content, err := ioutil.ReadFile(fp)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("Unable to read %s: %s", fp, err)
+	}
+	name := ""
+	for _, line := range strings.SplitAfter(string(content), "\n") {
+		if m := start.FindStringSubmatch(line); m != nil {
+			name = m[1]
+		}
+		if name != "" && !crit.matches(name, "") {
+			all[name] += line
+		}
+	}
+	for name, sql := range entries {
+		all[name] = sql
+	}
+
+	var names []string
+	for name := range all {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var sql string
+	for _, name := range names {
+		sql += all[name]
+	}
+	return crit.state().writeFile(fp, []byte(sql), objType)
+}
+
+// This strips the extension(s) off of an object's backup file name
+func objectFileBaseName(fileName string) string {
+	for _, ext := range []string{".sample.csv.stale", ".csv.stale", ".sample.csv"} {
+		if strings.HasSuffix(fileName, ext) {
+			return strings.TrimSuffix(fileName, ext)
+		}
+	}
+	return strings.TrimSuffix(fileName, filepath.Ext(fileName))
 }
 
 func qStr(str string) string {
@@ -14,9 +14,11 @@ package backup
 
 import (
 	"crypto/tls"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"io/ioutil"
+	"math"
 	"os"
 	"path/filepath"
 	"regexp"
@@ -120,10 +122,14 @@ func (s *testSuite) expectDir(dir string, expected dt) {
 	for _, fd := range got {
 		name := fd.Name()
 		fullPath := filepath.Join(dir, name)
+		if dir == s.testDir && (name == manifestFile || name == sessionFile) && expected[name] == nil {
+			continue // Unless explicitly expected this is checked via s.manifest()
+		}
 		if fd.IsDir() {
 			s.Containsf(expected, name, "Extra directory in backup %s", fullPath)
 			expDir := expected[name]
 			if expDir == nil {
+				delete(expected, name) // The directory's content isn't checked
 				continue
 			}
 			s.expectDir(fullPath, expDir.(dt))
@@ -133,6 +139,7 @@ func (s *testSuite) expectDir(dir string, expected dt) {
 			s.Containsf(expected, name, "Extra file in backup %s", fullPath)
 			expContent := expected[name]
 			if expContent == nil {
+				delete(expected, name) // The file's content isn't checked
 				continue
 			}
 			gotContent, err := ioutil.ReadFile(fullPath)
@@ -154,6 +161,12 @@ func (s *testSuite) expectDir(dir string, expected dt) {
 	s.Emptyf(expected, "Missing backup entries under %s:\n%v", dir, expected)
 }
 
+func (s *testSuite) manifest() *manifest {
+	m, err := loadManifest(s.testDir)
+	s.NoError(err, "Unable to load manifest")
+	return m
+}
+
 func (s *testSuite) TestParameters() {
 	s.backup(Conf{}, PARAMETERS)
 	s.expect(dt{
@@ -189,6 +202,139 @@ func (s *testSuite) TestParameters() {
 	})
 }
 
+func (s *testSuite) TestSessionRestored() {
+	s.execute(`CREATE TABLE [test].T (a DECIMAL(18,0))`)
+	s.execute(`INSERT INTO [test].T VALUES (1)`)
+	s.execute(`ALTER SESSION SET NLS_TIMESTAMP_FORMAT='YYYY-MM-DD HH24:MI:SS'`)
+
+	s.backup(Conf{MaxTableRows: 100}, TABLES)
+	attr, err := s.exaConn.GetSessionAttr()
+	s.NoError(err)
+	s.False(attr.Autocommit)
+	s.Equal("YYYY-MM-DD HH24:MI:SS", attr.DatetimeFormat)
+
+	// Including when the backup fails
+	err = Backup(Conf{
+		Source:       s.exaConn,
+		Destination:  s.testDir,
+		LogLevel:     s.loglevel,
+		Objects:      []Object{TABLES},
+		RowFilters:   map[string]string{"test.*": "no_such_column = 1"},
+		MaxTableRows: 100,
+	})
+	s.Error(err)
+	attr, err = s.exaConn.GetSessionAttr()
+	s.NoError(err)
+	s.False(attr.Autocommit)
+	s.Equal("YYYY-MM-DD HH24:MI:SS", attr.DatetimeFormat)
+
+	s.exaConn.Commit()
+	s.exaConn.EnableAutoCommit()
+	s.backup(Conf{}, TABLES)
+	attr, err = s.exaConn.GetSessionAttr()
+	s.NoError(err)
+	s.True(attr.Autocommit)
+
+	s.exaConn.DisableAutoCommit()
+	s.execute(`ALTER SESSION SET NLS_TIMESTAMP_FORMAT='YYYY-MM-DD HH24:MI:SS.FF6'`)
+}
+
+func (s *testSuite) TestFirstManifest() {
+	m, err := loadManifest(s.testDir)
+	s.NoError(err)
+	s.False(m.Started.IsZero())
+	s.Equal(s.testDir, m.dst)
+	s.NotNil(m.previous)
+
+	s.backup(Conf{}, SCHEMAS)
+	content, err := ioutil.ReadFile(filepath.Join(s.testDir, manifestFile))
+	s.NoError(err)
+	written := map[string]interface{}{}
+	s.NoError(json.Unmarshal(content, &written))
+	s.NotEqual("0001-01-01T00:00:00Z", written["started"])
+}
+
+func (s *testSuite) TestSnapshot() {
+	s.execute(`CREATE TABLE [test].T (a DECIMAL(18,0))`)
+	s.backup(Conf{Snapshot: true}, SCHEMAS, TABLES)
+	s.expect(dt{
+		"schemas": dt{
+			"test": dt{
+				"schema.sql": s.schemaSQL,
+				"tables":     dt{"T.sql": nil},
+			},
+		},
+	})
+	m := s.manifest()
+	s.Require().NotNil(m.Snapshot)
+	s.NotEmpty(m.Snapshot.Session)
+	s.NotEmpty(m.Snapshot.Started)
+
+	// The snapshot mode is only enabled for the backup
+	res, err := s.exaConn.FetchSlice(`
+		SELECT session_value FROM exa_parameters
+		WHERE parameter_name = 'SNAPSHOT_MODE'
+	`)
+	s.NoError(err)
+	s.Equal("OFF", res[0][0])
+
+	// Nor is the snapshot of a previous run retained
+	s.backup(Conf{}, SCHEMAS)
+	s.Nil(s.manifest().Snapshot)
+}
+
+func (s *testSuite) TestLock() {
+	host, _ := os.Hostname()
+	writeLock := func(pid int, started time.Time) {
+		content, _ := json.Marshal(destLock{PID: pid, Host: host, Started: started})
+		ioutil.WriteFile(filepath.Join(s.testDir, lockFile), content, 0644)
+	}
+	backup := func(cnf Conf) error {
+		cnf.Source = s.exaConn
+		cnf.Destination = s.testDir
+		cnf.LogLevel = s.loglevel
+		cnf.Objects = []Object{SCHEMAS}
+		return Backup(cnf)
+	}
+
+	// A lock held by a running backup
+	writeLock(os.Getpid(), time.Now())
+	err := backup(Conf{})
+	s.Error(err)
+	s.Contains(err.Error(), "locked by another backup")
+	err = backup(Conf{LockTimeout: 1500 * time.Millisecond})
+	s.Error(err)
+	s.expect(dt{lockFile: nil})
+
+	// Unless it's older than the stale age
+	writeLock(os.Getpid(), time.Now().Add(-time.Hour))
+	s.NoError(backup(Conf{StaleLockAge: time.Minute}))
+	s.expect(dt{"schemas": nil})
+
+	// As is an unreadable one whose file is older than the stale age
+	fp := filepath.Join(s.testDir, lockFile)
+	ioutil.WriteFile(fp, []byte(`{"pid":`), 0644)
+	err = backup(Conf{StaleLockAge: time.Minute})
+	s.Error(err)
+	s.Contains(err.Error(), "locked by another backup")
+	os.Chtimes(fp, time.Now().Add(-time.Hour), time.Now().Add(-time.Hour))
+	s.NoError(backup(Conf{StaleLockAge: time.Minute}))
+	s.expect(dt{"schemas": nil})
+
+	// A lock held by a process that no longer exists is stale
+	writeLock(math.MaxInt32, time.Now())
+	s.NoError(backup(Conf{}))
+	s.expect(dt{"schemas": nil})
+
+	// A lock taken over by another backup isn't removed by its former holder
+	lock, err := lockDestination(s.testDir, 0, 0)
+	s.Require().NoError(err)
+	writeLock(os.Getpid(), time.Now())
+	lock.release()
+	s.expect(dt{"schemas": nil, lockFile: nil})
+	os.Remove(filepath.Join(s.testDir, lockFile))
+}
+
 func (s *testSuite) TestSchemas() {
 	adapterSQL := `
 		CREATE LUA ADAPTER SCRIPT [test].vs_adapter AS
@@ -273,19 +419,21 @@ func (s *testSuite) TestTables() {
 			"A" DECIMAL(18,0) IDENTITY 321 NOT NULL COMMENT IS 'column A comment',
 			"B" DECIMAL(18,0) COMMENT IS 'column B comment',
 			"C" DECIMAL(18,0) DEFAULT 123 CONSTRAINT "cnst" NOT NULL DISABLE,
-			FOREIGN KEY ("B","C") REFERENCES "test"."T1" ("A","B") DISABLE,
 			CONSTRAINT "mypk" PRIMARY KEY ("A","C"),
 			DISTRIBUTE BY "A","B",
 			PARTITION BY "B","C"
 		) COMMENT IS 'table comment';
 	`
+	// Foreign keys are added after all tables are created and loaded
+	foreignKeySQL := `ALTER TABLE "test"."T2" ADD FOREIGN KEY ("B","C") REFERENCES "test"."T1" ("A","B") DISABLE;` + "\n"
 	data1SQL := `INSERT INTO [test].T1 VALUES (2,3), (3,4);`
 	data2SQL := `INSERT INTO [test].T2 VALUES (1,2,3), (2,3,4);`
-	s.execute(table1SQL, table2SQL, data1SQL, data2SQL)
+	s.execute(table1SQL, table2SQL, foreignKeySQL, data1SQL, data2SQL)
 	s.backup(Conf{MaxTableRows: 0}, TABLES)
 	s.expect(dt{
 		"schemas": dt{
 			"test": dt{
+				"constraints.sql": foreignKeySQL,
 				"tables": dt{
 					"T1.sql": table1SQL,
 					"T2.sql": table2SQL,
@@ -299,6 +447,8 @@ func (s *testSuite) TestTables() {
 	s.expect(dt{
 		"schemas": dt{
 			"test": dt{
+				"constraints.sql": foreignKeySQL,
+				"identities.sql":  `ALTER TABLE "test"."T2" ALTER COLUMN "A" SET IDENTITY 321;` + "\n",
 				"tables": dt{
 					"T1.sql": table1SQL,
 					"T2.sql": table2SQL,
@@ -311,7 +461,7 @@ func (s *testSuite) TestTables() {
 
 	// Test --drop-extras
 	s.execute("DROP TABLE t2")
-	s.backup(Conf{DropExtras: true}, TABLES)
+	s.backup(Conf{DropExtras: true, MaxTableRows: 100}, TABLES)
 	s.expect(dt{
 		"schemas": dt{
 			"test": dt{
@@ -322,6 +472,722 @@ func (s *testSuite) TestTables() {
 			},
 		},
 	})
+
+	// Data no longer qualifying for backup is marked as stale
+	s.backup(Conf{MaxTableRows: 1}, TABLES)
+	s.expect(dt{
+		"schemas": dt{
+			"test": dt{
+				"tables": dt{
+					"T1.sql":       table1SQL,
+					"T1.csv.stale": "2,3\n3,4\n",
+				},
+			},
+		},
+	})
+
+	// Or removed if dropping extras
+	s.backup(Conf{MaxTableRows: 100}, TABLES)
+	s.backup(Conf{DropExtras: true}, TABLES)
+	s.expect(dt{
+		"schemas": dt{
+			"test": dt{
+				"tables": dt{
+					"T1.sql": table1SQL,
+				},
+			},
+		},
+	})
+}
+
+func (s *testSuite) TestCreateIfNotExists() {
+	s.execute(`
+		CREATE OR REPLACE TABLE "test"."T1" (
+			"A" DECIMAL(18,0) IDENTITY 321 NOT NULL COMMENT IS 'column A comment',
+			"B" DECIMAL(18,0) DEFAULT 123,
+			CONSTRAINT "mypk" PRIMARY KEY ("A") DISABLE,
+			DISTRIBUTE BY "A",
+			PARTITION BY "B"
+		) COMMENT IS 'table''s comment'
+	`)
+	s.backup(Conf{TableDDL: CREATE_IF_NOT_EXISTS}, TABLES)
+	tableSQL := `
+		CREATE TABLE IF NOT EXISTS "test"."T1" (
+			"A" DECIMAL(18,0) IDENTITY 321 NOT NULL,
+			"B" DECIMAL(18,0) DEFAULT 123
+		);
+		ALTER TABLE "test"."T1" DROP CONSTRAINT IF EXISTS "mypk";
+		ALTER TABLE "test"."T1" ADD CONSTRAINT "mypk" PRIMARY KEY ("A") DISABLE;
+		ALTER TABLE "test"."T1" DISTRIBUTE BY "A";
+		ALTER TABLE "test"."T1" PARTITION BY "B";
+		COMMENT ON TABLE "test"."T1" IS 'table''s comment';
+		COMMENT ON COLUMN "test"."T1"."A" IS 'column A comment';
+	`
+	s.expect(dt{
+		"schemas": dt{
+			"test": dt{
+				"tables": dt{
+					"T1.sql": tableSQL,
+				},
+			},
+		},
+	})
+
+	// Running it against the populated table is harmless
+	s.execute(`INSERT INTO [test].T1 (b) VALUES 1`)
+	for _, stmt := range strings.Split(strings.TrimSpace(tableSQL), ";") {
+		if strings.TrimSpace(stmt) != "" {
+			s.execute(stmt)
+		}
+	}
+	res, err := s.exaConn.FetchSlice("SELECT COUNT(*) FROM [test].T1")
+	s.NoError(err)
+	s.Equal(float64(1), res[0][0])
+}
+
+func (s *testSuite) TestForeignKeys() {
+	s.execute(`CREATE OR REPLACE TABLE [test].A (a DECIMAL(18,0) PRIMARY KEY)`)
+	s.execute(`CREATE OR REPLACE TABLE [test].B (
+		a DECIMAL(18,0),
+		CONSTRAINT "fk_a" FOREIGN KEY (a) REFERENCES [test].A (a) ENABLE
+	)`)
+	s.execute(`CREATE OR REPLACE TABLE [test].C (b DECIMAL(18,0))`)
+	s.execute(`ALTER TABLE [test].C ADD CONSTRAINT "fk_a2" FOREIGN KEY (b) REFERENCES [test].A (a) DISABLE`)
+	s.execute(`ALTER TABLE [test].A ADD CONSTRAINT "fk_self" FOREIGN KEY (a) REFERENCES [test].A (a) DISABLE`)
+
+	s.backup(Conf{}, TABLES)
+	s.expect(dt{
+		"schemas": dt{
+			"test": dt{
+				"constraints.sql": `ALTER TABLE "test"."A" ADD CONSTRAINT "fk_self" FOREIGN KEY ("A") REFERENCES "test"."A" ("A") DISABLE;
+					ALTER TABLE "test"."B" ADD CONSTRAINT "fk_a" FOREIGN KEY ("A") REFERENCES "test"."A" ("A");
+					ALTER TABLE "test"."C" ADD CONSTRAINT "fk_a2" FOREIGN KEY ("B") REFERENCES "test"."A" ("A") DISABLE;
+				`,
+				"tables": nil,
+			},
+		},
+	})
+
+	// Foreign keys of tables outside of the criteria are retained
+	s.execute(`ALTER TABLE [test].C DROP CONSTRAINT "fk_a2"`)
+	s.execute(`ALTER TABLE [test].A DROP CONSTRAINT "fk_self"`)
+	s.backup(Conf{Match: "test.C"}, TABLES)
+	s.expect(dt{
+		"schemas": dt{
+			"test": dt{
+				"constraints.sql": `ALTER TABLE "test"."A" ADD CONSTRAINT "fk_self" FOREIGN KEY ("A") REFERENCES "test"."A" ("A") DISABLE;
+					ALTER TABLE "test"."B" ADD CONSTRAINT "fk_a" FOREIGN KEY ("A") REFERENCES "test"."A" ("A");
+				`,
+				"tables": nil,
+			},
+		},
+	})
+
+	// The constraints are re-added by name when not replacing tables
+	s.backup(Conf{TableDDL: CREATE_IF_NOT_EXISTS}, TABLES)
+	s.expect(dt{
+		"schemas": dt{
+			"test": dt{
+				"constraints.sql": `ALTER TABLE "test"."B" DROP CONSTRAINT IF EXISTS "fk_a"; ALTER TABLE "test"."B" ADD CONSTRAINT "fk_a" FOREIGN KEY ("A") REFERENCES "test"."A" ("A");
+				`,
+				"tables": nil,
+			},
+		},
+	})
+}
+
+func (s *testSuite) TestIdentities() {
+	s.execute(`CREATE OR REPLACE TABLE [test].A (a DECIMAL(18,0) IDENTITY 10, b DECIMAL(18,0))`)
+	s.execute(`CREATE OR REPLACE TABLE [test].B (a DECIMAL(18,0) IDENTITY 10)`)
+	s.execute(`INSERT INTO [test].A VALUES (1,1), (55,2)`)
+	s.execute(`INSERT INTO [test].B VALUES (3)`)
+
+	// The identity is moved past the largest loaded value
+	s.backup(Conf{MaxTableRows: 100}, TABLES)
+	s.expect(dt{
+		"schemas": dt{
+			"test": dt{
+				"identities.sql": `ALTER TABLE "test"."A" ALTER COLUMN "A" SET IDENTITY 56;
+					ALTER TABLE "test"."B" ALTER COLUMN "A" SET IDENTITY 10;
+				`,
+				"tables": nil,
+			},
+		},
+	})
+	m := s.manifest()
+	s.Equal(map[string]string{"A": "56"}, m.Tables["test.A"].Identities)
+	s.Equal(map[string]string{"A": "10"}, m.Tables["test.B"].Identities)
+
+	// Nothing needs to be moved if the data isn't backed up
+	s.backup(Conf{MaxTableRows: 1}, TABLES)
+	s.expect(dt{
+		"schemas": dt{
+			"test": dt{
+				"identities.sql": `ALTER TABLE "test"."B" ALTER COLUMN "A" SET IDENTITY 10;` + "\n",
+				"tables":         nil,
+			},
+		},
+	})
+}
+
+func (s *testSuite) TestCSVFormat() {
+	tableSQL := `
+		CREATE OR REPLACE TABLE "test"."T1" (
+			"A" DECIMAL(18,0),
+			"B" VARCHAR(10) UTF8,
+			"C" BOOLEAN
+		);
+	`
+	viewSQL := `CREATE OR REPLACE FORCE VIEW "test"."V1" AS SELECT 'a,b' AS c`
+	dataSQL := `INSERT INTO [test].T1 VALUES (1,'x,y',TRUE), (2,NULL,FALSE);`
+	s.execute(tableSQL, viewSQL, dataSQL)
+
+	tabs := CSVFormat{ColumnSeparator: "TAB", Null: `\N`, Boolean: "1/0", Encoding: "UTF8"}
+	s.backup(Conf{
+		MaxTableRows: 100,
+		MaxViewRows:  100,
+		CSVFormat:    CSVFormat{ColumnDelimiter: "'"},
+		CSVFormats:   map[string]CSVFormat{"test.T*": tabs},
+	}, TABLES, VIEWS)
+	s.expect(dt{
+		"schemas": dt{
+			"test": dt{
+				"tables": dt{
+					"T1.sql": tableSQL,
+					"T1.csv": "1\t'x,y'\t1\n2\t\\N\t0\n",
+				},
+				"views": dt{
+					"V1.sql": "OPEN SCHEMA [test];\n" + viewSQL + ";\n",
+					"V1.csv": "'a,b'\n",
+				},
+			},
+		},
+	})
+
+	m := s.manifest()
+	s.Equal(&dataEntry{
+		Schema: "test",
+		Name:   "T1",
+		File:   "schemas/test/tables/T1.csv",
+		Format: CSVFormat{ColumnSeparator: "TAB", ColumnDelimiter: "'", Null: `\N`, Boolean: "1/0", Encoding: "UTF8"},
+	}, m.Tables["test.T1"])
+	s.Equal(&dataEntry{
+		Schema: "test",
+		Name:   "V1",
+		File:   "schemas/test/views/V1.csv",
+		Format: CSVFormat{ColumnDelimiter: "'"},
+	}, m.Views["test.V1"])
+}
+
+func (s *testSuite) TestTimestampPrecision() {
+	tableSQL := `
+		CREATE OR REPLACE TABLE "test"."T1" (
+			"A" TIMESTAMP(0),
+			"B" TIMESTAMP(3),
+			"C" TIMESTAMP(9),
+			"D" DATE
+		);
+	`
+	dataSQL := `INSERT INTO [test].T1 VALUES (
+		'2020-01-02 03:04:05',
+		'2020-01-02 03:04:05.123',
+		'2020-01-02 03:04:05.123456789',
+		'2020-01-02'
+	)`
+	s.execute(tableSQL, dataSQL)
+	s.execute(`ALTER SESSION SET NLS_DATE_FORMAT='DD.MM.YYYY'`)
+
+	s.backup(Conf{MaxTableRows: 100}, TABLES)
+	s.expect(dt{
+		"session.sql": `ALTER SESSION SET NLS_DATE_FORMAT='DD.MM.YYYY';
+			ALTER SESSION SET NLS_DATE_LANGUAGE='ENG';
+			ALTER SESSION SET NLS_NUMERIC_CHARACTERS='.,';
+			ALTER SESSION SET NLS_TIMESTAMP_FORMAT='YYYY-MM-DD HH24:MI:SS.FF3';
+			ALTER SESSION SET TIME_ZONE='EUROPE/BERLIN';
+			ALTER SESSION SET TIME_ZONE_BEHAVIOR='INVALID SHIFT AMBIGUOUS ST';
+		`,
+		"schemas": dt{
+			"test": dt{
+				"tables": dt{
+					"T1.sql": tableSQL,
+					"T1.csv": "2020-01-02 03:04:05,2020-01-02 03:04:05.123,2020-01-02 03:04:05.123456789,02.01.2020\n",
+				},
+			},
+		},
+	})
+	m := s.manifest()
+	s.Equal("DD.MM.YYYY", m.Session["NLS_DATE_FORMAT"])
+	s.Equal("YYYY-MM-DD HH24:MI:SS.FF3", m.Session["NLS_TIMESTAMP_FORMAT"])
+	s.execute(`ALTER SESSION SET NLS_DATE_FORMAT='YYYY-MM-DD'`)
+}
+
+func (s *testSuite) TestRowFilters() {
+	tableSQL := `
+		CREATE OR REPLACE TABLE "test"."T1" (
+			"A" DECIMAL(18,0),
+			"B" VARCHAR(10) UTF8
+		);
+	`
+	dataSQL := `INSERT INTO [test].T1 VALUES (1,'x%'), (2,'y'), (3,'z'), (4,'x1');`
+	s.execute(tableSQL, dataSQL)
+
+	// The filtered row count is what's compared to MaxTableRows
+	s.backup(Conf{
+		MaxTableRows: 2,
+		RowFilters:   map[string]string{"test.*": "b LIKE 'x%'"},
+	}, TABLES)
+	s.expect(dt{
+		"schemas": dt{
+			"test": dt{
+				"tables": dt{
+					"T1.sql": tableSQL,
+					"T1.csv": "1,x%\n4,x1\n",
+				},
+			},
+		},
+	})
+	s.Equal("b LIKE 'x%'", s.manifest().Tables["test.T1"].Filter)
+}
+
+func (s *testSuite) TestMasks() {
+	tableSQL := `
+		CREATE OR REPLACE TABLE "test"."T1" (
+			"ID" DECIMAL(18,0),
+			"NAME" VARCHAR(20) UTF8,
+			"EMAIL" VARCHAR(100) UTF8,
+			"CODE" VARCHAR(10) UTF8,
+			"DOB" DATE
+		);
+	`
+	viewSQL := `CREATE OR REPLACE FORCE VIEW "test"."V1" AS SELECT "NAME", "CODE" FROM "test"."T1"`
+	dataSQL := `INSERT INTO [test].T1 VALUES (1,'Joe','joe@x.com','Ab-12','1980-02-03');`
+	s.execute(tableSQL, viewSQL, dataSQL)
+
+	res, err := s.exaConn.FetchSlice("SELECT HASH_SHA256('salt' || 'joe@x.com')")
+	s.NoError(err)
+	emailHash := res[0][0].(string)
+	from, to := fakeSubstitution("seed")
+	fakeCode := strings.Map(func(r rune) rune {
+		if i := strings.IndexRune(from, r); i >= 0 {
+			return rune(to[i])
+		}
+		return r
+	}, "Ab-12")
+
+	s.backup(Conf{
+		MaxTableRows: 100,
+		MaxViewRows:  100,
+		Masks: map[string]Mask{
+			"test.*.name":  {Method: MASK_TRUNCATE, Length: 1},
+			"test.t1.name": {Method: MASK_NULL},
+			"test.*.email": {Method: MASK_HASH, Value: "salt"},
+			"*.*.code":     {Method: MASK_FAKE, Value: "seed"},
+			"test.t1.dob":  {Method: MASK_CONSTANT, Value: "2000-01-01"},
+		},
+	}, TABLES, VIEWS)
+	s.expect(dt{
+		"schemas": dt{
+			"test": dt{
+				"tables": dt{
+					"T1.sql": tableSQL,
+					"T1.csv": "1,," + emailHash + "," + fakeCode + ",2000-01-01\n",
+				},
+				"views": dt{
+					"V1.sql": "OPEN SCHEMA [test];\n" + viewSQL + ";\n",
+					"V1.csv": "J," + fakeCode + "\n",
+				},
+			},
+		},
+	})
+
+	m := s.manifest()
+	s.Equal(map[string]string{
+		"NAME":  "null",
+		"EMAIL": "hash",
+		"CODE":  "fake",
+		"DOB":   "constant",
+	}, m.Tables["test.T1"].Masked)
+	s.Equal(map[string]string{
+		"NAME": "truncate",
+		"CODE": "fake",
+	}, m.Views["test.V1"].Masked)
+
+	for _, mask := range []Mask{
+		{Method: MASK_HASH},
+		{Method: MASK_TRUNCATE},
+		{Method: MASK_TRUNCATE, Length: -1},
+	} {
+		err = Backup(Conf{
+			Source:      s.exaConn,
+			Destination: s.testDir,
+			LogLevel:    s.loglevel,
+			Objects:     []Object{TABLES},
+			Masks:       map[string]Mask{"test.t1.name": mask},
+		})
+		s.Error(err, "%+v", mask)
+	}
+}
+
+func (s *testSuite) TestExportError() {
+	s.execute("CREATE TABLE [test].T1 (a DECIMAL(18,0))", "INSERT INTO [test].T1 VALUES (1)")
+	s.execute("CREATE TABLE [test].T2 (a DECIMAL(18,0))", "INSERT INTO [test].T2 VALUES (1)")
+
+	// The constant can't be cast to a DECIMAL so exporting T1 fails.
+	// The error is returned rather than the backup waiting on its data.
+	done := make(chan error)
+	go func() {
+		done <- Backup(Conf{
+			Source:       s.exaConn,
+			Destination:  s.testDir,
+			LogLevel:     s.loglevel,
+			Objects:      []Object{TABLES},
+			MaxTableRows: 100,
+			Masks:        map[string]Mask{"test.T1.a": {Method: MASK_CONSTANT, Value: "oops"}},
+		})
+	}()
+	select {
+	case err := <-done:
+		s.Error(err)
+		s.Contains(err.Error(), "Unable to read table test.T1")
+	case <-time.After(time.Minute):
+		s.Fail("The backup hung on the failed export")
+	}
+}
+
+func (s *testSuite) TestMaxTableBytes() {
+	tableSQL := `
+		CREATE OR REPLACE TABLE "test"."T1" (
+			"A" DECIMAL(18,0)
+		);
+	`
+	dataSQL := `INSERT INTO [test].T1 VALUES 1, 2, 3;`
+	s.execute(tableSQL, dataSQL)
+
+	// The byte limit on its own enables data backups
+	s.backup(Conf{MaxTableBytes: 1e12}, TABLES)
+	s.expect(dt{
+		"schemas": dt{
+			"test": dt{
+				"tables": dt{
+					"T1.sql": tableSQL,
+					"T1.csv": "1\n2\n3\n",
+				},
+			},
+		},
+	})
+
+	// When combined both limits have to be satisfied
+	os.Remove(filepath.Join(s.testDir, "schemas", "test", "tables", "T1.csv"))
+	s.backup(Conf{MaxTableBytes: 1e12, MaxTableCompressedBytes: 1e12, MaxTableRows: 2}, TABLES)
+	s.expect(dt{
+		"schemas": dt{
+			"test": dt{
+				"tables": dt{
+					"T1.sql": tableSQL,
+				},
+			},
+		},
+	})
+}
+
+func (s *testSuite) TestSamples() {
+	s.execute(`CREATE OR REPLACE TABLE [test].T1 (a DECIMAL(18,0) PRIMARY KEY)`)
+	s.execute(`CREATE OR REPLACE TABLE [test].T2 (b DECIMAL(18,0), a DECIMAL(18,0) REFERENCES [test].T1 (a))`)
+	s.execute(`INSERT INTO [test].T1 SELECT level FROM DUAL CONNECT BY level <= 20`)
+	s.execute(`INSERT INTO [test].T2 SELECT level, MOD(level, 20) + 1 FROM DUAL CONNECT BY level <= 40`)
+	s.backup(Conf{MaxTableRows: 10, SampleRows: 5}, TABLES)
+
+	dir := filepath.Join(s.testDir, "schemas", "test", "tables")
+	readRows := func(file string) []string {
+		content, err := ioutil.ReadFile(filepath.Join(dir, file))
+		s.NoError(err, "Unable to read sample")
+		return strings.Split(strings.TrimSpace(string(content)), "\n")
+	}
+	parents := readRows("T1.sample.csv")
+	s.Len(parents, 5)
+	s.NoFileExists(filepath.Join(dir, "T1.csv"))
+
+	// Every sampled child row references a sampled parent row
+	children := readRows("T2.sample.csv")
+	s.NotEmpty(children)
+	for _, child := range children {
+		s.Contains(parents, strings.Split(child, ",")[1])
+	}
+
+	// Samples are deterministic
+	s.backup(Conf{MaxTableRows: 10, SampleRows: 5}, TABLES)
+	s.Equal(parents, readRows("T1.sample.csv"))
+
+	m := s.manifest()
+	s.True(m.Tables["test.T1"].Sample)
+	s.Equal("schemas/test/tables/T1.sample.csv", m.Tables["test.T1"].File)
+}
+
+func (s *testSuite) TestSkipUnchangedData() {
+	tableSQL := `
+		CREATE OR REPLACE TABLE "test"."T1" (
+			"A" DECIMAL(18,0)
+		);
+	`
+	s.execute(tableSQL, `INSERT INTO [test].T1 VALUES 1, 2`)
+	s.exaConn.Commit() // So that Exasol records a last commit for the table
+	defer func() {
+		s.execute("DROP SCHEMA [test] CASCADE")
+		s.exaConn.Commit()
+	}()
+
+	cnf := Conf{MaxTableRows: 100, SkipUnchangedData: true}
+	s.backup(cnf, TABLES)
+	s.NotEmpty(s.manifest().Tables["test.T1"].Fingerprint)
+
+	// An unchanged table isn't re-exported
+	csv := filepath.Join(s.testDir, "schemas", "test", "tables", "T1.csv")
+	s.NoError(ioutil.WriteFile(csv, []byte("untouched\n"), 0644))
+	s.backup(cnf, TABLES)
+	s.expect(dt{
+		"schemas": dt{
+			"test": dt{
+				"tables": dt{
+					"T1.sql": tableSQL,
+					"T1.csv": "untouched\n",
+				},
+			},
+		},
+	})
+
+	// But it is if the data changes
+	s.execute(`INSERT INTO [test].T1 VALUES 3`)
+	s.exaConn.Commit()
+	s.backup(cnf, TABLES)
+	s.expect(dt{
+		"schemas": dt{
+			"test": dt{
+				"tables": dt{
+					"T1.sql": tableSQL,
+					"T1.csv": "1\n2\n3\n",
+				},
+			},
+		},
+	})
+
+	// Or if the way it's exported changes
+	s.NoError(ioutil.WriteFile(csv, []byte("untouched\n"), 0644))
+	cnf.CSVFormat = CSVFormat{RowSeparator: "CRLF"}
+	s.backup(cnf, TABLES)
+	content, err := ioutil.ReadFile(csv)
+	s.NoError(err)
+	s.Equal("1\r\n2\r\n3\r\n", string(content))
+
+	// A deterministic row filter doesn't stop the data being skipped
+	cnf.CSVFormat = CSVFormat{}
+	cnf.RowFilters = map[string]string{"test.T1": "a > 1"}
+	s.backup(cnf, TABLES)
+	s.NoError(ioutil.WriteFile(csv, []byte("untouched\n"), 0644))
+	s.backup(cnf, TABLES)
+	content, err = ioutil.ReadFile(csv)
+	s.NoError(err)
+	s.Equal("untouched\n", string(content))
+
+	// Unless asked to
+	cnf.ReexportFilteredData = true
+	s.backup(cnf, TABLES)
+	content, err = ioutil.ReadFile(csv)
+	s.NoError(err)
+	s.Equal("2\n3\n", string(content))
+
+	// But one relative to the current time does
+	cnf.ReexportFilteredData = false
+	cnf.RowFilters = map[string]string{"test.T1": "a < YEAR(CURRENT_DATE)"}
+	s.backup(cnf, TABLES)
+	s.NoError(ioutil.WriteFile(csv, []byte("untouched\n"), 0644))
+	s.backup(cnf, TABLES)
+	content, err = ioutil.ReadFile(csv)
+	s.NoError(err)
+	s.Equal("1\n2\n3\n", string(content))
+}
+
+func (s *testSuite) TestDropLimits() {
+	tables := dt{}
+	var drops []string
+	for i := 1; i <= 16; i++ {
+		t := fmt.Sprintf("T%d", i)
+		s.execute(fmt.Sprintf("CREATE TABLE [test].%s (a DECIMAL(18,0))", t))
+		tables[t+".sql"] = nil
+		if i > 1 && i <= 13 {
+			drops = append(drops, "DROP TABLE [test]."+t)
+		}
+	}
+	s.backup(Conf{}, TABLES)
+	s.execute(drops...)
+	allTables := dt{"schemas": dt{"test": dt{"tables": tables}}}
+	backup := func(cnf Conf) error {
+		cnf.Source = s.exaConn
+		cnf.Destination = s.testDir
+		cnf.LogLevel = s.loglevel
+		cnf.Objects = []Object{TABLES}
+		cnf.DropExtras = true
+		return Backup(cnf)
+	}
+
+	err := backup(Conf{MaxDrops: 2})
+	s.Error(err)
+	s.Contains(err.Error(), "Refusing to drop 12 extraneous tables files")
+	s.expect(allTables)
+
+	err = backup(Conf{MaxDropPercent: 50})
+	s.Error(err)
+	s.Contains(err.Error(), "Refusing to drop 12 of 16 tables files")
+	s.expect(allTables)
+
+	// Without any limits mass drops are still refused
+	err = backup(Conf{})
+	s.Error(err)
+	s.Contains(err.Error(), "Refusing to drop 12 of 16 tables files")
+	s.expect(allTables)
+
+	s.NoError(backup(Conf{MaxDrops: 2, MaxDropPercent: 50, ForceDrops: true}))
+	remaining := dt{"T1.sql": nil, "T14.sql": nil, "T15.sql": nil, "T16.sql": nil}
+	s.expect(dt{"schemas": dt{"test": dt{"tables": remaining}}})
+
+	// Dropping a few files is within any percentage
+	s.execute("DROP TABLE [test].T14")
+	s.NoError(backup(Conf{MaxDropPercent: 10}))
+	delete(remaining, "T14.sql")
+	s.expect(dt{"schemas": dt{"test": dt{"tables": remaining}}})
+
+	// The data files no longer backed up count towards the limits too
+	s.execute("INSERT INTO [test].T1 VALUES (1)", "INSERT INTO [test].T15 VALUES (1)")
+	s.backup(Conf{MaxTableRows: 100}, TABLES)
+	err = backup(Conf{MaxDrops: 1})
+	s.Error(err)
+	s.Contains(err.Error(), "Refusing to drop 2 extraneous tables data files")
+	remaining["T15.csv"] = nil
+	s.expect(dt{"schemas": dt{"test": dt{"tables": remaining}}})
+}
+
+func (s *testSuite) TestQuarantineDrops() {
+	s.execute("CREATE TABLE [test].T1 (a DECIMAL(18,0))")
+	s.execute("CREATE TABLE [test].T2 (a DECIMAL(18,0))")
+	s.execute("INSERT INTO [test].T2 VALUES (1)")
+	s.backup(Conf{MaxTableRows: 100}, TABLES)
+
+	expired := filepath.Join(s.testDir, quarantineDir, "20000101T000000")
+	os.MkdirAll(expired, os.ModePerm)
+	ioutil.WriteFile(filepath.Join(expired, "T.sql"), []byte{}, 0644)
+
+	s.execute("DROP TABLE [test].T2")
+	s.backup(Conf{DropExtras: true, QuarantineDrops: true, QuarantineDays: 30}, TABLES)
+
+	dirs, err := ioutil.ReadDir(filepath.Join(s.testDir, quarantineDir))
+	s.NoError(err)
+	s.Require().Len(dirs, 1)
+	s.expect(dt{
+		quarantineDir: dt{
+			dirs[0].Name(): dt{
+				"schemas": dt{
+					"test": dt{
+						"tables": dt{
+							"T2.sql": nil,
+							"T2.csv": "1\n",
+						},
+					},
+				},
+			},
+		},
+		"schemas": dt{
+			"test": dt{
+				"tables": dt{"T1.sql": nil},
+			},
+		},
+	})
+
+	// So are the data files no longer backed up
+	s.execute("INSERT INTO [test].T1 VALUES (1)")
+	s.backup(Conf{MaxTableRows: 100}, TABLES)
+	s.backup(Conf{DropExtras: true, QuarantineDrops: true}, TABLES)
+	quarantined, err := filepath.Glob(filepath.Join(s.testDir, quarantineDir, "*", "schemas", "test", "tables", "T1.csv"))
+	s.NoError(err)
+	s.Len(quarantined, 1)
+	s.expect(dt{
+		quarantineDir: nil,
+		"schemas": dt{
+			"test": dt{
+				"tables": dt{"T1.sql": nil},
+			},
+		},
+	})
+}
+
+func (s *testSuite) TestQuarantineWithoutManifest() {
+	s.execute("CREATE TABLE [test].T1 (a DECIMAL(18,0))")
+	s.execute("CREATE TABLE [test].T2 (a DECIMAL(18,0))")
+	s.backup(Conf{}, TABLES)
+
+	// As with a destination backed up before there were manifests
+	conf := Conf{DropExtras: true, QuarantineDrops: true, QuarantineDays: 30}
+	os.Remove(filepath.Join(s.testDir, manifestFile))
+	s.execute("DROP TABLE [test].T2")
+	s.backup(conf, TABLES)
+	os.Remove(filepath.Join(s.testDir, manifestFile))
+	s.backup(conf, TABLES)
+
+	dirs, err := ioutil.ReadDir(filepath.Join(s.testDir, quarantineDir))
+	s.NoError(err)
+	s.Require().Len(dirs, 1)
+	s.NotEqual(time.Time{}.Format(quarantineTimeFormat), dirs[0].Name())
+	s.expect(dt{
+		quarantineDir: dt{
+			dirs[0].Name(): dt{
+				"schemas": dt{
+					"test": dt{
+						"tables": dt{"T2.sql": nil},
+					},
+				},
+			},
+		},
+		"schemas": dt{
+			"test": dt{
+				"tables": dt{"T1.sql": nil},
+			},
+		},
+	})
+}
+
+func (s *testSuite) TestDryRun() {
+	table1SQL := "CREATE OR REPLACE TABLE \"test\".\"T1\" (\n\t\"A\" DECIMAL(18,0)\n);\n"
+	table2SQL := "CREATE OR REPLACE TABLE \"test\".\"T2\" (\n\t\"A\" DECIMAL(18,0)\n);\n"
+	s.execute(table1SQL, table2SQL)
+	s.backup(Conf{}, TABLES)
+
+	s.execute("ALTER TABLE [test].T1 ADD COLUMN b DECIMAL(18,0)")
+	s.execute("DROP TABLE [test].T2")
+	s.execute("CREATE TABLE [test].T3 (a DECIMAL(18,0))")
+	changes, err := DryRun(Conf{
+		Source:      s.exaConn,
+		Destination: s.testDir,
+		LogLevel:    s.loglevel,
+		Objects:     []Object{TABLES},
+		DropExtras:  true,
+	})
+	s.NoError(err)
+	s.Equal([]FileChange{
+		{"manifest.json", MODIFIED, "manifest", "changed since the last backup"},
+		{"schemas/test/tables/T1.sql", MODIFIED, "tables", "changed since the last backup"},
+		{"schemas/test/tables/T2.sql", REMOVED, "tables", "no longer exists in Exasol"},
+		{"schemas/test/tables/T3.sql", CREATED, "tables", "not backed up before"},
+	}, changes)
+
+	// Nothing was written
+	s.expect(dt{
+		"schemas": dt{
+			"test": dt{
+				"tables": dt{
+					"T1.sql": table1SQL,
+					"T2.sql": table2SQL,
+				},
+			},
+		},
+	})
 }
 
 func (s *testSuite) TestViews() {
@@ -361,7 +1227,7 @@ func (s *testSuite) TestViews() {
 
 	// Test --drop-extras
 	s.execute("DROP VIEW v2")
-	s.backup(Conf{DropExtras: true}, VIEWS)
+	s.backup(Conf{DropExtras: true, MaxViewRows: 100}, VIEWS)
 	s.expect(dt{
 		"schemas": dt{
 			"test": dt{
@@ -373,6 +1239,19 @@ func (s *testSuite) TestViews() {
 		},
 	})
 
+	// View data no longer qualifying for backup is marked as stale
+	s.backup(Conf{}, VIEWS)
+	s.expect(dt{
+		"schemas": dt{
+			"test": dt{
+				"views": dt{
+					"V 1.sql":       openSchemaSQL + view1SQL + ";\n",
+					"V 1.csv.stale": "\"Hi Mom!!\"\n",
+				},
+			},
+		},
+	})
+
 	// Test renamed views
 	s.execute("RENAME VIEW [V 1] TO v3")
 	view3SQL := regexp.MustCompile("V 1").ReplaceAllString(view1SQL, "V3")
@@ -657,6 +1536,180 @@ func (s *testSuite) TestPrivileges() {
 	})
 }
 
+func (s *testSuite) TestTypeCriteria() {
+	s.execute("CREATE TABLE [test].T1 (a DECIMAL(18,0))")
+	s.execute("CREATE TABLE [test].T2 (a DECIMAL(18,0))")
+	s.execute("CREATE VIEW [test].V1 AS SELECT 1 AS a")
+	s.execute("CREATE VIEW [test].V2 AS SELECT 2 AS a")
+	s.execute("INSERT INTO [test].T1 VALUES (1)")
+	s.execute("INSERT INTO [test].T2 VALUES (2)")
+
+	s.backup(Conf{
+		Skip: "test.V2",
+		TypeCriteria: map[Object]TypeCriteria{
+			TABLES: {Match: "test.T2"},
+		},
+		DataMatch: "test.T*,test.V1",
+	}, TABLES, VIEWS)
+	s.expect(dt{
+		"schemas": dt{
+			"test": dt{
+				"tables": dt{
+					"T2.sql": nil,
+					"T2.csv": "2\n",
+				},
+				"views": dt{
+					"V1.sql": nil,
+					"V1.csv": "1\n",
+				},
+			},
+		},
+	})
+
+	// Data matching overrides the limits
+	s.execute("INSERT INTO [test].T1 VALUES (3), (4)")
+	s.backup(Conf{MaxTableRows: 1, DataMatch: "test.T1"}, TABLES)
+	s.expect(dt{
+		"schemas": dt{
+			"test": dt{
+				"tables": dt{
+					"T1.sql": nil,
+					"T1.csv": "1\n3\n4\n",
+					"T2.sql": nil,
+					"T2.csv": "2\n",
+				},
+				"views": nil,
+			},
+		},
+	})
+}
+
+func (s *testSuite) TestGlobalCriteria() {
+	s.execute("DROP USER IF EXISTS t1_joe")
+	s.execute("DROP USER IF EXISTS t2_jane")
+	s.execute("DROP CONNECTION IF EXISTS t1_conn")
+	s.execute("DROP CONNECTION IF EXISTS t2_conn")
+	s.execute(
+		"CREATE USER [T1_JOE] IDENTIFIED BY KERBEROS PRINCIPAL 'joe'",
+		"CREATE USER [T2_JANE] IDENTIFIED BY KERBEROS PRINCIPAL 'jane'",
+		"CREATE OR REPLACE CONNECTION T1_CONN TO 'someplace'",
+		"CREATE OR REPLACE CONNECTION T2_CONN TO 'elsewhere'",
+	)
+	s.backup(Conf{
+		TypeCriteria: map[Object]TypeCriteria{
+			USERS:       {Match: "T*", Skip: "T2_*"},
+			CONNECTIONS: {Match: "T2_*"},
+		},
+	}, USERS, CONNECTIONS)
+	s.expect(dt{
+		"users": dt{
+			"T1_JOE.sql": "CREATE USER [T1_JOE] IDENTIFIED BY KERBEROS PRINCIPAL 'joe';\n",
+		},
+		"connections.sql": "CREATE OR REPLACE CONNECTION T2_CONN TO 'elsewhere' USER '' IDENTIFIED BY ********;\n",
+	})
+
+	// The connections outside of the criteria are kept
+	s.backup(Conf{TypeCriteria: map[Object]TypeCriteria{CONNECTIONS: {Match: "T1_*"}}}, CONNECTIONS)
+	s.expect(dt{
+		"users": dt{"T1_JOE.sql": nil},
+		"connections.sql": "CREATE OR REPLACE CONNECTION T1_CONN TO 'someplace' USER '' IDENTIFIED BY ********;\n" +
+			"CREATE OR REPLACE CONNECTION T2_CONN TO 'elsewhere' USER '' IDENTIFIED BY ********;\n",
+	})
+
+	// Only the files of the users matching are dropped
+	ioutil.WriteFile(filepath.Join(s.testDir, "users", "T1_GONE.sql"), []byte{}, 0644)
+	ioutil.WriteFile(filepath.Join(s.testDir, "users", "OTHER.sql"), []byte{}, 0644)
+	s.backup(Conf{
+		DropExtras: true,
+		TypeCriteria: map[Object]TypeCriteria{
+			USERS: {Match: "T1_*"},
+		},
+	}, USERS)
+	s.expect(dt{
+		"users": dt{
+			"T1_JOE.sql": nil,
+			"OTHER.sql":  "",
+		},
+		"connections.sql": nil,
+	})
+	s.execute("DROP USER t1_joe", "DROP USER t2_jane", "DROP CONNECTION t1_conn", "DROP CONNECTION t2_conn")
+
+	// Global objects' names have only the one part
+	s.NoError(validatePatterns(Conf{TypeCriteria: map[Object]TypeCriteria{TABLES: {Match: "a.b"}}}))
+	s.Error(validatePatterns(Conf{TypeCriteria: map[Object]TypeCriteria{USERS: {Match: "a.b"}}}))
+}
+
+func (s *testSuite) TestPreviewCriteria() {
+	s.execute("CREATE TABLE [test].T1 (a DECIMAL(18,0))")
+	s.execute("CREATE TABLE [test].T2 (a DECIMAL(18,0))")
+	s.execute("CREATE TABLE [test].T3 (a DECIMAL(18,0)) COMMENT IS 'scratch @backup:skip'")
+	s.execute("CREATE VIEW [test].V1 AS SELECT 1 AS a")
+
+	testObjects := func(preview *CriteriaPreview) []ObjectMatch {
+		var got []ObjectMatch
+		for _, om := range preview.Objects {
+			if om.Schema == "test" {
+				got = append(got, om)
+			}
+		}
+		return got
+	}
+
+	preview, err := PreviewCriteria(Conf{
+		Source:  s.exaConn,
+		Objects: []Object{SCHEMAS, TABLES, VIEWS},
+		Match:   "test.T*,test.V*,test.test,nope.*",
+		Skip:    "test.T2,test.X*",
+	})
+	s.NoError(err)
+	s.Equal([]ObjectMatch{
+		{"test", "", "SCHEMA", true, `Match pattern "test.test"`},
+		{"test", "T1", "TABLE", true, `Match pattern "test.T*"`},
+		{"test", "T2", "TABLE", false, `Skip pattern "test.T2"`},
+		{"test", "T3", "TABLE", false, `@backup:skip annotation`},
+		{"test", "V1", "VIEW", true, `Match pattern "test.V*"`},
+	}, testObjects(preview))
+	s.Equal([]string{
+		`Match pattern "nope.*" matches nothing`,
+		`Skip pattern "test.X*" matches nothing`,
+	}, preview.Warnings)
+
+	// The TypeCriteria and filters are those of the backup
+	preview, err = PreviewCriteria(Conf{
+		Source:       s.exaConn,
+		Objects:      []Object{TABLES, VIEWS},
+		Match:        "test.T1",
+		Owner:        "NOBODY",
+		TypeCriteria: map[Object]TypeCriteria{VIEWS: {Match: "test.X*"}},
+	})
+	s.NoError(err)
+	s.Equal([]ObjectMatch{
+		{"test", "T1", "TABLE", false, "Owner/ModifiedSince filter"},
+		{"test", "T2", "TABLE", false, "no Match pattern"},
+		{"test", "T3", "TABLE", false, "no Match pattern"},
+		{"test", "V1", "VIEW", false, "no Match pattern"},
+	}, testObjects(preview))
+	s.Equal([]string{`VIEWS Match pattern "test.X*" matches nothing`}, preview.Warnings)
+
+	preview, err = PreviewCriteria(Conf{
+		Source:      s.exaConn,
+		Objects:     []Object{ALL},
+		Match:       `test\.V.*`,
+		RegexpMatch: true,
+	})
+	s.NoError(err)
+	for _, om := range testObjects(preview) {
+		if om.Object == "T1" {
+			s.False(om.Included)
+			s.Equal("no Match pattern", om.Rule)
+		}
+		if om.Object == "V1" {
+			s.True(om.Included)
+		}
+	}
+	s.Empty(preview.Warnings)
+}
+
 func (s *testSuite) TestCriteria() {
 	tests := [][]string{
 		// regexpMatch, matchCriteria, skipCriteria, schemaToBeChecked, objectToBeChecked, expectedReturn
@@ -723,3 +1776,321 @@ func (s *testSuite) TestCriteria() {
 		s.Equal(exp, got)
 	}
 }
+
+func (s *testSuite) TestRegexpCache() {
+	cache := newRegexpCache()
+	crit := Criteria{
+		match:       `sch\.(?!tmp_).*`,
+		skip:        `.*\.obj2`,
+		regexpMatch: true,
+		exaConn:     s.exaConn,
+		run:         &backupRun{regexpCache: cache},
+	}
+	var names [][2]string
+	for i := 0; i < regexpBatchSize+10; i++ {
+		names = append(names, [2]string{"sch", fmt.Sprintf("obj%d", i)})
+	}
+	names = append(names, [2]string{"sch", "tmp_obj"}, [2]string{"sch", ""})
+	crit.prefetch(names)
+
+	matched, ok := cache.get(crit.match, "sch.tmp_obj")
+	s.True(ok)
+	s.False(matched)
+	_, ok = cache.get(crit.skip, fmt.Sprintf("sch.obj%d", regexpBatchSize+9))
+	s.True(ok, "Names beyond the first batch are cached")
+
+	// Matching now needs no queries
+	crit.exaConn = nil
+	s.True(crit.matches("sch", "obj1"))
+	s.False(crit.matches("sch", "obj2"))
+	s.False(crit.matches("sch", "tmp_obj"))
+	s.True(crit.matches("sch", ""))
+}
+
+func (s *testSuite) TestCriteriaFile() {
+	cf, err := parseCriteriaFile("# comment\n\nsch1\n  sch2.T*  \n!sch2.TMP_*\n\\!odd.name\n")
+	s.NoError(err)
+	s.Equal(&CriteriaFile{Rules: []CriteriaRule{
+		{Pattern: "sch1"},
+		{Pattern: "sch2.T*"},
+		{Pattern: "sch2.TMP_*", Skip: true},
+		{Pattern: "!odd.name"},
+	}}, cf)
+
+	// Leading with a "!" line matches everything else
+	cf, err = parseCriteriaFile("!SCRATCH\n")
+	s.NoError(err)
+	s.Equal(&CriteriaFile{Rules: []CriteriaRule{
+		{Pattern: "*.*"},
+		{Pattern: "SCRATCH", Skip: true},
+	}}, cf)
+
+	cf, err = parseCriteriaFile("sch1.T*\nre:sch2\\.(?!TMP_).*\n!re:.*_OLD\nre:sch3\\..*\n")
+	s.NoError(err)
+	s.Equal(&CriteriaFile{Rules: []CriteriaRule{
+		{Pattern: "sch1.T*"},
+		{Pattern: `sch2\.(?!TMP_).*`, Regexp: true},
+		{Pattern: `.*_OLD`, Skip: true, Regexp: true},
+		{Pattern: `sch3\..*`, Regexp: true},
+	}}, cf)
+	crit := Criteria{rules: cf.Rules, exaConn: s.exaConn}
+	s.True(crit.matches("sch1", "t_1"))
+	s.True(crit.matches("sch1", ""), "The schema of a wildcard pattern matches")
+	s.True(crit.matches("sch2", "t_1"))
+	s.False(crit.matches("sch2", "tmp_1"))
+	s.False(crit.matches("sch1", "t_old"))
+	s.True(crit.matches("sch3", "t_old"), "A later line re-includes")
+	s.False(crit.matches("sch4", "t_1"))
+
+	// The last matching line wins
+	cf, err = parseCriteriaFile("!STAGE_*\nSTAGE_KEEP.*\n")
+	s.NoError(err)
+	crit = Criteria{rules: cf.Rules, exaConn: s.exaConn}
+	s.True(crit.matches("other", "t_1"))
+	s.False(crit.matches("stage_1", "t_1"))
+	s.False(crit.matches("stage_1", ""))
+	s.True(crit.matches("stage_keep", "t_1"))
+	s.True(crit.matches("stage_keep", ""))
+	cf, err = parseCriteriaFile("sch1.T*\n!sch1.*\n")
+	s.NoError(err)
+	crit = Criteria{rules: cf.Rules, exaConn: s.exaConn}
+	s.False(crit.matches("sch1", "t_1"))
+
+	_, err = parseCriteriaFile("sch1,sch2\n")
+	s.Error(err)
+
+	s.execute("CREATE TABLE [test].T1 (a DECIMAL(18,0))")
+	s.execute("CREATE TABLE [test].TMP_T2 (a DECIMAL(18,0))")
+	fp := filepath.Join(s.T().TempDir(), "criteria.txt")
+	ioutil.WriteFile(fp, []byte("# Not the scratch tables\n!test.TMP_*\n"), 0644)
+	s.backup(Conf{CriteriaFile: fp}, TABLES)
+	s.expect(dt{
+		"schemas": dt{
+			"test": dt{
+				"tables": dt{
+					"T1.sql": nil,
+				},
+			},
+		},
+	})
+
+	// But for the one that's re-included
+	s.execute("CREATE TABLE [test].TMP_KEEP (a DECIMAL(18,0))")
+	ioutil.WriteFile(fp, []byte("!test.TMP_*\ntest.TMP_KEEP\n"), 0644)
+	s.backup(Conf{CriteriaFile: fp}, TABLES)
+	s.expect(dt{
+		"schemas": dt{
+			"test": dt{
+				"tables": dt{
+					"T1.sql":       nil,
+					"TMP_KEEP.sql": nil,
+				},
+			},
+		},
+	})
+}
+
+func (s *testSuite) TestAnnotations() {
+	s.Equal(true, hasAnnotation("Scratch table @BACKUP:SKIP", skipAnnotation))
+	s.Equal(false, hasAnnotation("@backup:skipped", skipAnnotation))
+	s.Equal(false, hasAnnotation("@backup:data", skipAnnotation))
+
+	s.execute("CREATE TABLE [test].T1 (a DECIMAL(18,0))")
+	s.execute("CREATE TABLE [test].T2 (a DECIMAL(18,0)) COMMENT IS 'scratch @backup:skip'")
+	s.execute("CREATE TABLE [test].T3 (a DECIMAL(18,0)) COMMENT IS 'lookups @backup:data'")
+	s.execute("INSERT INTO [test].T1 VALUES (1)")
+	s.execute("INSERT INTO [test].T3 VALUES (3)")
+	s.execute(`CREATE OR REPLACE LUA SCALAR SCRIPT [test].S1 () RETURNS DECIMAL(18,0) AS
+		function run(ctx)
+			return 1
+		end
+	`)
+	s.execute("COMMENT ON SCRIPT [test].S1 IS '@backup:skip'")
+	s.backup(Conf{}, TABLES, SCRIPTS)
+	expected := dt{
+		"schemas": dt{
+			"test": dt{
+				"tables": dt{
+					"T1.sql": nil,
+					"T3.sql": nil,
+					"T3.csv": "3\n",
+				},
+			},
+		},
+	}
+	s.expect(expected)
+
+	s.NotNil(s.manifest().Tables["test.T3"])
+
+	// Skipping the schema leaves its files as they are
+	s.execute("COMMENT ON SCHEMA [test] IS 'scratch @backup:skip'")
+	s.backup(Conf{DropExtras: true}, SCHEMAS, TABLES, SCRIPTS)
+	s.expect(expected)
+	s.NotNil(s.manifest().Tables["test.T3"], "Along with their manifest entries")
+
+	s.execute("COMMENT ON SCHEMA [test] IS ''")
+	s.execute("COMMENT ON TABLE [test].T3 IS 'lookups @backup:data @backup:skip'")
+	s.backup(Conf{DropExtras: true}, SCHEMAS, TABLES, SCRIPTS)
+	s.expect(expected)
+	s.NotNil(s.manifest().Tables["test.T3"])
+}
+
+func (s *testSuite) TestObjectFilters() {
+	s.execute("CREATE TABLE [test].T1 (a DECIMAL(18,0))")
+	s.execute("CREATE TABLE [test].T2 (a DECIMAL(18,0))")
+	s.exaConn.Commit()
+	s.backup(Conf{Owner: "NOBODY*"}, TABLES)
+	_, err := os.Stat(filepath.Join(s.testDir, "schemas", "test", "tables"))
+	s.True(os.IsNotExist(err))
+
+	// With no previous backup everything is backed up
+	s.backup(Conf{Incremental: true}, TABLES)
+	s.expect(dt{
+		"schemas": dt{
+			"test": dt{
+				"tables": dt{
+					"T1.sql": nil,
+					"T2.sql": nil,
+				},
+			},
+		},
+	})
+	s.NotEmpty(s.manifest().CatalogTime)
+
+	t1 := filepath.Join(s.testDir, "schemas", "test", "tables", "T1.sql")
+	ioutil.WriteFile(t1, []byte("unchanged"), 0644)
+	s.execute("ALTER TABLE [test].T2 ADD COLUMN b DECIMAL(18,0)")
+	s.execute("CREATE TABLE [test].T3 (a DECIMAL(18,0))")
+	s.exaConn.Commit()
+	s.backup(Conf{Incremental: true, DropExtras: true}, TABLES)
+	s.expect(dt{
+		"schemas": dt{
+			"test": dt{
+				"tables": dt{
+					"T1.sql": "unchanged",
+					"T2.sql": nil,
+					"T3.sql": nil,
+				},
+			},
+		},
+	})
+	t2, _ := ioutil.ReadFile(filepath.Join(s.testDir, "schemas", "test", "tables", "T2.sql"))
+	s.Contains(string(t2), `"B" DECIMAL(18,0)`)
+
+	s.backup(Conf{ModifiedSince: time.Now().AddDate(-10, 0, 0)}, TABLES)
+	t1Content, _ := ioutil.ReadFile(t1)
+	s.NotEqual("unchanged", string(t1Content))
+
+	// The time is converted to the session's time zone
+	ioutil.WriteFile(t1, []byte("unchanged"), 0644)
+	s.execute("ALTER TABLE [test].T1 ADD COLUMN b DECIMAL(18,0)")
+	s.exaConn.Commit()
+	ahead := time.FixedZone("UTC+14", 14*60*60)
+	s.backup(Conf{ModifiedSince: time.Now().Add(-5 * time.Minute).In(ahead)}, TABLES)
+	t1Content, _ = ioutil.ReadFile(t1)
+	s.Contains(string(t1Content), `"B" DECIMAL(18,0)`)
+}
+
+func (s *testSuite) TestPatterns() {
+	patterns, err := parsePatterns(` "my.schema"."a,b" , sch\.1.T\*X*,"say ""hi"""`, 2)
+	s.NoError(err)
+	s.Len(patterns, 3)
+	s.True(patterns[0].matches("MY.SCHEMA", "A,B"))
+	s.False(patterns[0].matches("my.schema", "a"))
+	s.True(patterns[1].matches("sch.1", "t*xyz"))
+	s.False(patterns[1].matches("sch.1", "tyxyz"))
+	s.True(patterns[2].matches(`say "hi"`, "anything"))
+	s.Equal(`"my.schema"."a,b"`, patterns[0].String())
+	s.Equal(`"sch.1"."T*X"*`, patterns[1].String())
+
+	// LIKE wildcards are escaped
+	patterns, err = parsePatterns(`s%.o_*`, 2)
+	s.NoError(err)
+	s.Equal(`UPPER(local.o) LIKE UPPER('o\_%') ESCAPE '\'`, patterns[0].name(1).sql("local.o"))
+	s.Equal(`UPPER(local.s) LIKE UPPER('s\%') ESCAPE '\'`, patterns[0].name(0).sql("local.s"))
+	s.Equal(`'(?i)^(?:a''b|c)$'`, regexpSQL("a'b|c"))
+
+	for _, bad := range []string{"", "a,,b", "a.", `"a`, `a\`, `""`, "a.b.c"} {
+		_, err = parsePatterns(bad, 2)
+		s.Error(err, bad)
+	}
+	s.Error(Backup(Conf{Source: s.exaConn, Destination: s.testDir, Match: "a.b.c"}))
+
+	s.execute(`CREATE TABLE [test]."A_B" (a DECIMAL(18,0))`)
+	s.execute(`CREATE TABLE [test]."AXB" (a DECIMAL(18,0))`)
+	s.execute(`CREATE TABLE [test]."my.table" (a DECIMAL(18,0))`)
+	s.backup(Conf{Match: `test.a_b, test."my.table"`}, TABLES)
+	s.expect(dt{
+		"schemas": dt{
+			"test": dt{
+				"tables": dt{
+					"A_B.sql":      nil,
+					"my.table.sql": nil,
+				},
+			},
+		},
+	})
+}
+
+// This checks that the SQL generated from any pattern keeps the pattern
+// within string literals and matches the same names as the Go matcher.
+// Run via: go test -run '^$' -fuzz FuzzPatternSQL
+func FuzzPatternSQL(f *testing.F) {
+	for _, seed := range []string{
+		"*.*", "sch.obj", `"a.b".c`, `a\,b.*`, "x%_y.'; DROP TABLE t; --", `"""".*`,
+	} {
+		f.Add(seed, "SCH", "OBJ")
+	}
+	initLogging("fatal") // Invalid patterns are logged
+	f.Fuzz(checkPatternSQL)
+}
+
+var sqlLiteral = regexp.MustCompile(`'(?:[^']|'')*'`)
+var safeSQL = regexp.MustCompile(`^[\sA-Za-z_().,]*$`)
+var likeLiteral = regexp.MustCompile(`LIKE UPPER\('((?:[^']|'')*)'\)`)
+
+func checkPatternSQL(t *testing.T, str, schema, object string) {
+	for _, regexpMatch := range []bool{false, true} {
+		sql := buildCriteria(str, regexpMatch)
+		rest := sqlLiteral.ReplaceAllString(sql, "")
+		if !safeSQL.MatchString(rest) {
+			t.Fatalf("%q produced unsafe SQL: %s", str, sql)
+		}
+	}
+
+	patterns, err := parsePatterns(str, 2)
+	if err != nil {
+		return
+	}
+	sql := buildCriteria(str, false)
+	likes := likeLiteral.FindAllStringSubmatch(sql, -1)
+	if len(likes) != 2*len(patterns) {
+		t.Fatalf("%q produced %d LIKEs for %d patterns: %s", str, len(likes), len(patterns), sql)
+	}
+	for i, p := range patterns {
+		sqlMatch := simulateLike(likes[2*i][1], schema) && simulateLike(likes[2*i+1][1], object)
+		if sqlMatch != p.matches(schema, object) {
+			t.Fatalf("%q matches %q.%q differently in SQL (%v): %s", str, schema, object, sqlMatch, sql)
+		}
+	}
+}
+
+// This evaluates UPPER(name) LIKE UPPER(literal) ESCAPE '\' as Exasol would
+func simulateLike(literal, name string) bool {
+	like := []rune(strings.ToUpper(strings.ReplaceAll(literal, "''", "'")))
+	re := "(?s)^"
+	for i := 0; i < len(like); i++ {
+		switch like[i] {
+		case '\\':
+			i++
+			re += regexp.QuoteMeta(string(like[i]))
+		case '%':
+			re += ".*"
+		case '_':
+			re += "."
+		default:
+			re += regexp.QuoteMeta(string(like[i]))
+		}
+	}
+	return regexp.MustCompile(re + "$").MatchString(strings.ToUpper(name))
+}
@@ -0,0 +1,119 @@
+/*
+	This command lists the schema objects in an Exasol database and whether
+	a backup with the given criteria would include them. e.g.
+
+	exasol-backup-preview -host exasol1 -user sys -match 'stage_*.*' -skip '*.tmp_*'
+
+	The password is read from the EXA_PASSWORD environment variable
+	unless it's given by -password.
+*/
+
+package main
+
+import (
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/GrantStreetGroup/go-exasol-backup"
+	"github.com/GrantStreetGroup/go-exasol-client"
+)
+
+func main() {
+	host := flag.String("host", "localhost", "Exasol hostname")
+	port := flag.Int("port", 8563, "Exasol port")
+	user := flag.String("user", "sys", "Exasol username")
+	pass := flag.String("password", os.Getenv("EXA_PASSWORD"), "Exasol password")
+	insecure := flag.Bool("insecure", false, "Skip verifying Exasol's TLS certificate")
+	objects := flag.String("objects", "", "Comma delimited object types to preview e.g. tables,views (Default all)")
+	match := flag.String("match", "", "Match patterns (see backup.Conf)")
+	skip := flag.String("skip", "", "Skip patterns")
+	regexpMatch := flag.Bool("regexp", false, "Interpret -match and -skip as regular expressions")
+	criteriaFile := flag.String("criteria-file", "", "File of Match and Skip patterns")
+	owner := flag.String("owner", "", "Owner patterns")
+	modifiedSince := flag.String("modified-since", "", `Only objects changed since then (in local time) e.g. "2024-01-31 12:00:00"`)
+	excluded := flag.Bool("excluded", true, "Also list the objects which would be excluded")
+	logLevel := flag.String("loglevel", "warning", "Log level")
+	flag.Parse()
+
+	cfg := backup.Conf{
+		Match:        *match,
+		Skip:         *skip,
+		RegexpMatch:  *regexpMatch,
+		CriteriaFile: *criteriaFile,
+		Owner:        *owner,
+		LogLevel:     *logLevel,
+	}
+	for _, o := range strings.Split(*objects, ",") {
+		if o == "" {
+			continue
+		}
+		obj, ok := objectTypes[strings.ToLower(strings.TrimSpace(o))]
+		if !ok {
+			fatalf("Unknown object type %q", o)
+		}
+		cfg.Objects = append(cfg.Objects, obj)
+	}
+	if *modifiedSince != "" {
+		t, err := time.ParseInLocation("2006-01-02 15:04:05", *modifiedSince, time.Local)
+		if err != nil {
+			fatalf("Invalid -modified-since: %s", err)
+		}
+		cfg.ModifiedSince = t
+	}
+
+	conn, err := exasol.Connect(exasol.ConnConf{
+		Host:      *host,
+		Port:      uint16(*port),
+		Username:  *user,
+		Password:  *pass,
+		TLSConfig: &tls.Config{InsecureSkipVerify: *insecure},
+	})
+	if err != nil {
+		fatalf("Unable to connect to Exasol: %s", err)
+	}
+	defer conn.Disconnect()
+	cfg.Source = conn
+
+	preview, err := backup.PreviewCriteria(cfg)
+	if err != nil {
+		conn.Disconnect()
+		fatalf("%s", err)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "TYPE\tNAME\tINCLUDED\tRULE")
+	for _, om := range preview.Objects {
+		if !om.Included && !*excluded {
+			continue
+		}
+		name := om.Schema
+		if om.Object != "" {
+			name += "." + om.Object
+		}
+		included := "no"
+		if om.Included {
+			included = "yes"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", om.Type, name, included, om.Rule)
+	}
+	w.Flush() // The warnings have been logged
+}
+
+var objectTypes = map[string]backup.Object{
+	"all":       backup.ALL,
+	"schemas":   backup.SCHEMAS,
+	"tables":    backup.TABLES,
+	"views":     backup.VIEWS,
+	"scripts":   backup.SCRIPTS,
+	"functions": backup.FUNCTIONS,
+}
+
+func fatalf(format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, format+"\n", args...)
+	os.Exit(1)
+}
@@ -2,9 +2,8 @@ package backup
 
 import (
 	"fmt"
-	"io/ioutil"
-	"os"
 	"path/filepath"
+	"regexp"
 
 	"github.com/GrantStreetGroup/go-exasol-client"
 )
@@ -18,10 +17,11 @@ type connection struct {
 	comment  string
 }
 
-func BackupConnections(src *exasol.Conn, dst string) error {
+func BackupConnections(src *exasol.Conn, dst string, crit Criteria) error {
 	log.Info("Backing up connections")
+	run := crit.state()
 
-	connections, err := getConnectionsToBackup(src)
+	connections, err := getConnectionsToBackup(src, crit)
 	if err != nil {
 		return err
 	}
@@ -30,13 +30,13 @@ func BackupConnections(src *exasol.Conn, dst string) error {
 		return nil
 	}
 
-	var sql string
+	entries := map[string]string{}
 	for _, connection := range connections {
-		sql += createConnection(connection)
+		entries[connection.name] = createConnection(connection)
 	}
-	os.MkdirAll(dst, os.ModePerm)
+	run.makeDir(dst)
 	file := filepath.Join(dst, "connections.sql")
-	err = ioutil.WriteFile(file, []byte(sql), 0644)
+	err = writeObjectsFile(file, "connections", connectionStart, entries, crit)
 	if err != nil {
 		return fmt.Errorf("Unable to backup connections: %s", err)
 	}
@@ -45,15 +45,21 @@ func BackupConnections(src *exasol.Conn, dst string) error {
 	return nil
 }
 
-func getConnectionsToBackup(conn *exasol.Conn) ([]*connection, error) {
-	sql := `
-		SELECT connection_name,
+// The first line of each connection's entry in connections.sql
+var connectionStart = regexp.MustCompile(`^CREATE OR REPLACE CONNECTION (\S+) TO `)
+
+func getConnectionsToBackup(conn *exasol.Conn, crit Criteria) ([]*connection, error) {
+	sql := fmt.Sprintf(`
+		SELECT connection_name AS s,
+			   connection_name AS o,
 			   connection_string,
 			   user_name,
 			   connection_comment
 		FROM exa_dba_connections
-		ORDER BY connection_name
-	`
+		WHERE %s
+		ORDER BY local.s
+		`, crit.getSQLCriteria(),
+	)
 	res, err := conn.FetchSlice(sql)
 	if err != nil {
 		return nil, fmt.Errorf("Unable to get connections to backup: %s", err)
@@ -61,14 +67,14 @@ func getConnectionsToBackup(conn *exasol.Conn) ([]*connection, error) {
 	connections := []*connection{}
 	for _, row := range res {
 		c := &connection{name: row[0].(string)}
-		if row[1] != nil {
-			c.connStr = row[1].(string)
-		}
 		if row[2] != nil {
-			c.username = row[2].(string)
+			c.connStr = row[2].(string)
 		}
 		if row[3] != nil {
-			c.comment = row[3].(string)
+			c.username = row[3].(string)
+		}
+		if row[4] != nil {
+			c.comment = row[4].(string)
 		}
 		connections = append(connections, c)
 	}
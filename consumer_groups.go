@@ -2,9 +2,8 @@ package backup
 
 import (
 	"fmt"
-	"io/ioutil"
-	"os"
 	"path/filepath"
+	"regexp"
 
 	"github.com/GrantStreetGroup/go-exasol-client"
 )
@@ -24,10 +23,11 @@ type consumerGroup struct {
 	comment               string
 }
 
-func BackupConsumerGroups(src *exasol.Conn, dst string) error {
+func BackupConsumerGroups(src *exasol.Conn, dst string, crit Criteria) error {
 	log.Info("Backing up consumer groups")
+	run := crit.state()
 
-	consumerGroups, err := getConsumerGroupsToBackup(src)
+	consumerGroups, err := getConsumerGroupsToBackup(src, crit)
 	if err != nil {
 		return err
 	}
@@ -36,27 +36,30 @@ func BackupConsumerGroups(src *exasol.Conn, dst string) error {
 		return nil
 	}
 
-	var sql string
+	entries := map[string]string{}
 	for _, consumerGroup := range consumerGroups {
-		sql += createConsumerGroup(consumerGroup)
+		entries[consumerGroup.name] = createConsumerGroup(consumerGroup)
 	}
 
-	os.MkdirAll(dst, os.ModePerm)
+	run.makeDir(dst)
 	file := filepath.Join(dst, "consumer_groups.sql")
-	err = ioutil.WriteFile(file, []byte(sql), 0644)
+	err = writeObjectsFile(file, "consumer_groups", consumerGroupStart, entries, crit)
 	if err != nil {
 		return fmt.Errorf("Unable to backup consumer groups: %s", err)
 	}
 
 	// Drop the legacy priority groups file to avoid confusion.
 	// Depending on the Exasol version we have either consumer or priority groups.
-	os.Remove(filepath.Join(dst, "priority_groups.sql"))
+	run.removePath(filepath.Join(dst, "priority_groups.sql"), "priority_groups", "superseded by consumer groups")
 
 	log.Info("Done backing up consumer groups")
 	return nil
 }
 
-func getConsumerGroupsToBackup(conn *exasol.Conn) ([]*consumerGroup, error) {
+// The first line of each consumer group's entry in consumer_groups.sql
+var consumerGroupStart = regexp.MustCompile(`^(?:DROP|ALTER) CONSUMER GROUP \[([^\]]+)\]`)
+
+func getConsumerGroupsToBackup(conn *exasol.Conn, crit Criteria) ([]*consumerGroup, error) {
 	sql := `
 		SELECT system_value
 		FROM exa_parameters
@@ -68,8 +71,9 @@ func getConsumerGroupsToBackup(conn *exasol.Conn) ([]*consumerGroup, error) {
 	}
 	defaultGroup := res[0][0].(string)
 
-	sql = `
-		SELECT consumer_group_name,
+	sql = fmt.Sprintf(`
+		SELECT consumer_group_name AS s,
+			   consumer_group_name AS o,
 			   precedence,
 			   cpu_weight,
 			   group_temp_db_ram_limit,
@@ -79,8 +83,10 @@ func getConsumerGroupsToBackup(conn *exasol.Conn) ([]*consumerGroup, error) {
 			   idle_timeout,
 			   consumer_group_comment
 		FROM exa_consumer_groups
-		ORDER BY consumer_group_name
-	`
+		WHERE %s
+		ORDER BY local.s
+		`, crit.getSQLCriteria(),
+	)
 	res, err = conn.FetchSlice(sql)
 	if err != nil {
 		return nil, fmt.Errorf("Unable to get consumer groups to backup: %s", err)
@@ -90,26 +96,26 @@ func getConsumerGroupsToBackup(conn *exasol.Conn) ([]*consumerGroup, error) {
 		p := &consumerGroup{
 			name:       row[0].(string),
 			isDefault:  (row[0].(string) == defaultGroup),
-			precedence: int(row[1].(float64)),
-			cpuWeight:  int(row[2].(float64)),
-		}
-		if row[3] != nil {
-			p.groupTempDBRAMLimit = int(row[3].(float64))
+			precedence: int(row[2].(float64)),
+			cpuWeight:  int(row[3].(float64)),
 		}
 		if row[4] != nil {
-			p.userTempDBRAMLimit = int(row[4].(float64))
+			p.groupTempDBRAMLimit = int(row[4].(float64))
 		}
 		if row[5] != nil {
-			p.sessionTempDBRAMLimit = int(row[5].(float64))
+			p.userTempDBRAMLimit = int(row[5].(float64))
 		}
 		if row[6] != nil {
-			p.queryTimeout = int(row[6].(float64))
+			p.sessionTempDBRAMLimit = int(row[6].(float64))
 		}
 		if row[7] != nil {
-			p.idleTimeout = int(row[7].(float64))
+			p.queryTimeout = int(row[7].(float64))
 		}
 		if row[8] != nil {
-			p.comment = row[8].(string)
+			p.idleTimeout = int(row[8].(float64))
+		}
+		if row[9] != nil {
+			p.comment = row[9].(string)
 		}
 		consumerGroups = append(consumerGroups, p)
 	}
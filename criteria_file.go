@@ -0,0 +1,98 @@
+package backup
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// This reads the Match and Skip criteria from a file, one pattern per
+// line, rather than from comma delimited strings e.g.
+//
+//   # Everything in the reporting schemas
+//   REPORTING_*
+//   # but their scratch tables
+//   !REPORTING_*.TMP_*
+//   # other than the one that's kept
+//   REPORTING_SALES.TMP_TOTALS
+//   # and the objects of the old schemas but those ending in "_V2"
+//   re:OLD_[0-9]+\.(?!.*_V2$).*
+//
+// Each line is a "schema.object" pattern with the same rules as Match.
+// Lines starting with "!" are Skip patterns instead. Lines starting with
+// "re:" (after any "!") are regular expressions (see Conf.RegexpMatch).
+// Blank lines and lines starting with "#" are ignored. A leading "\"
+// escapes a "#" or "!" starting a pattern.
+//
+// As in a .gitignore the last line matching an object decides whether
+// it's backed up, so a later line can re-include what a "!" line skipped
+// (or skip what an earlier line matched). Objects no line matches aren't
+// backed up unless the first line is a "!" one (or there are none), in
+// which case everything is matched to begin with.
+
+const regexpPatternPrefix = "re:"
+
+// CriteriaFile is the criteria read from a file by ReadCriteriaFile()
+type CriteriaFile struct {
+	// The lines' patterns in the order of the file
+	Rules []CriteriaRule
+}
+
+// CriteriaRule is a single line of a criteria file
+type CriteriaRule struct {
+	Pattern string // A single pattern as in Conf.Match or a regexp
+	Skip    bool   // Whether it's a "!" line
+	Regexp  bool   // Whether it's a "re:" line
+}
+
+// ReadCriteriaFile parses the given criteria file into its rules
+func ReadCriteriaFile(path string) (*CriteriaFile, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read criteria file: %s", err)
+	}
+	cf, err := parseCriteriaFile(string(content))
+	if err != nil {
+		return nil, fmt.Errorf("Unable to parse criteria file %s: %s", path, err)
+	}
+	return cf, nil
+}
+
+func parseCriteriaFile(content string) (*CriteriaFile, error) {
+	cf := &CriteriaFile{}
+
+	for i, line := range strings.Split(content, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		rule := CriteriaRule{}
+		if strings.HasPrefix(line, "!") {
+			rule.Skip = true
+			line = line[1:]
+		}
+		if strings.HasPrefix(line, regexpPatternPrefix) {
+			rule.Pattern = line[len(regexpPatternPrefix):]
+			rule.Regexp = true
+			if rule.Pattern == "" {
+				return nil, fmt.Errorf("line %d: the pattern is empty", i+1)
+			}
+			cf.Rules = append(cf.Rules, rule)
+			continue
+		}
+		patterns, err := parsePatterns(line, 2)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", i+1, err)
+		}
+		if len(patterns) > 1 {
+			return nil, fmt.Errorf("line %d: only one pattern is allowed per line", i+1)
+		}
+		rule.Pattern = patterns[0].String()
+		cf.Rules = append(cf.Rules, rule)
+	}
+
+	if len(cf.Rules) == 0 || cf.Rules[0].Skip {
+		cf.Rules = append([]CriteriaRule{{Pattern: "*.*"}}, cf.Rules...)
+	}
+	return cf, nil
+}
@@ -0,0 +1,117 @@
+package backup
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// This controls the CSV dialect used when exporting table and view data
+
+type CSVFormat struct {
+	// Column separator e.g. ",", ";" or "TAB"
+	ColumnSeparator string `json:"column_separator,omitempty"`
+	// Column delimiter (i.e. quote character) e.g. '"'
+	ColumnDelimiter string `json:"column_delimiter,omitempty"`
+	// Row separator: "LF", "CRLF" or "CR"
+	RowSeparator string `json:"row_separator,omitempty"`
+	// File encoding e.g. "UTF8" or "ASCII"
+	Encoding string `json:"encoding,omitempty"`
+	// Representation of NULL values e.g. `\N`
+	Null string `json:"null,omitempty"`
+	// Representation of booleans e.g. "1/0" or "true/false"
+	Boolean string `json:"boolean,omitempty"`
+}
+
+// Unset fields of the receiver are filled in from the defaults
+func (f CSVFormat) withDefaults(defaults CSVFormat) CSVFormat {
+	if f.ColumnSeparator == "" {
+		f.ColumnSeparator = defaults.ColumnSeparator
+	}
+	if f.ColumnDelimiter == "" {
+		f.ColumnDelimiter = defaults.ColumnDelimiter
+	}
+	if f.RowSeparator == "" {
+		f.RowSeparator = defaults.RowSeparator
+	}
+	if f.Encoding == "" {
+		f.Encoding = defaults.Encoding
+	}
+	if f.Null == "" {
+		f.Null = defaults.Null
+	}
+	if f.Boolean == "" {
+		f.Boolean = defaults.Boolean
+	}
+	return f
+}
+
+// This returns the file options to append to an EXPORT statement.
+// Options that are not set are left to Exasol's defaults.
+func (f CSVFormat) exportOptions() string {
+	var opts []string
+	if f.Encoding != "" {
+		opts = append(opts, fmt.Sprintf("ENCODING = '%s'", qExportStr(f.Encoding)))
+	}
+	if f.Null != "" {
+		opts = append(opts, fmt.Sprintf("NULL = '%s'", qExportStr(f.Null)))
+	}
+	if f.Boolean != "" {
+		opts = append(opts, fmt.Sprintf("BOOLEAN = '%s'", qExportStr(f.Boolean)))
+	}
+	if f.RowSeparator != "" {
+		opts = append(opts, fmt.Sprintf("ROW SEPARATOR = '%s'", qExportStr(f.RowSeparator)))
+	}
+	if f.ColumnSeparator != "" {
+		opts = append(opts, fmt.Sprintf("COLUMN SEPARATOR = '%s'", qExportStr(f.ColumnSeparator)))
+	}
+	if f.ColumnDelimiter != "" {
+		opts = append(opts, fmt.Sprintf("COLUMN DELIMITER = '%s'", qExportStr(f.ColumnDelimiter)))
+	}
+	if len(opts) == 0 {
+		return ""
+	}
+	return " " + strings.Join(opts, " ")
+}
+
+// This returns the CSV format to use for the given table or view.
+func (d DataConf) csvFormat(schema, object string) CSVFormat {
+	var patterns []string
+	for p := range d.CSVFormats {
+		patterns = append(patterns, p)
+	}
+	pattern := matchingPattern(patterns, schema, object)
+	if pattern == "" {
+		return d.CSVFormat
+	}
+	return d.CSVFormats[pattern].withDefaults(d.CSVFormat)
+}
+
+// This returns the most specific (i.e. longest) wildcard "schema.object"
+// pattern that matches the object. If none match then "" is returned.
+func matchingPattern(patterns []string, schema, object string) string {
+	keys := append([]string{}, patterns...)
+	sort.Slice(keys, func(i, j int) bool {
+		if len(keys[i]) != len(keys[j]) {
+			return len(keys[i]) > len(keys[j])
+		}
+		return keys[i] < keys[j]
+	})
+	for _, k := range keys {
+		if matchesCriteria(k, schema, object, false, false, nil, nil) {
+			return k
+		}
+	}
+	return ""
+}
+
+// The SQL passed to StreamQuery is used as a format string
+// so literal percent signs need to be escaped.
+func qExportStr(str string) string {
+	return strings.ReplaceAll(qStr(str), "%", "%%")
+}
+
+// As with qExportStr() but for a (bracket quoted) identifier
+func qExportIdent(name string) string {
+	return strings.ReplaceAll(name, "%", "%%")
+}
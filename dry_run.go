@@ -0,0 +1,227 @@
+package backup
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// All changes to the destination go through the routines below so that
+// a dry run can instead record what would be created, modified or removed.
+
+type ChangeType byte
+
+const (
+	CREATED ChangeType = iota + 1
+	MODIFIED
+	REMOVED
+)
+
+var changeTypeNames = map[ChangeType]string{
+	CREATED:  "created",
+	MODIFIED: "modified",
+	REMOVED:  "removed",
+}
+
+func (c ChangeType) String() string {
+	return changeTypeNames[c]
+}
+
+// FileChange is a change a dry run found would be made to the destination
+type FileChange struct {
+	Path   string // Relative to the Destination
+	Change ChangeType
+	Object string // The type of object the file belongs to e.g. "tables"
+	Reason string
+}
+
+func (c FileChange) String() string {
+	return fmt.Sprintf("%-8s %s (%s: %s)", c.Change, c.Path, c.Object, c.Reason)
+}
+
+type dryRun struct {
+	dst     string
+	files   map[string]*plannedFile
+	removed map[string]*plannedFile
+	mux     sync.Mutex
+}
+
+type plannedFile struct {
+	content []byte
+	known   bool // false if the content isn't known up front e.g. for data
+	objType string
+	reason  string
+}
+
+func newDryRun(dst string) *dryRun {
+	return &dryRun{
+		dst:     dst,
+		files:   map[string]*plannedFile{},
+		removed: map[string]*plannedFile{},
+	}
+}
+
+func (r *backupRun) writeFile(fp string, content []byte, objType string) error {
+	d := r.dry()
+	if d == nil {
+		return ioutil.WriteFile(fp, content, 0644)
+	}
+	d.mux.Lock()
+	defer d.mux.Unlock()
+
+	d.files[fp] = &plannedFile{content: content, known: true, objType: objType}
+	return nil
+}
+
+func (r *backupRun) appendFile(fp string, content []byte) error {
+	d := r.dry()
+	if d == nil {
+		f, err := os.OpenFile(fp, os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = f.Write(content)
+		return err
+	}
+	d.mux.Lock()
+	defer d.mux.Unlock()
+
+	file := d.files[fp]
+	if file == nil {
+		return fmt.Errorf("%s was not written", fp)
+	}
+	file.content = append(append([]byte{}, file.content...), content...)
+	return nil
+}
+
+// This writes the data received to the file
+func (r *backupRun) writeDataFile(fp string, data <-chan []byte, objType string) error {
+	if d := r.dry(); d != nil {
+		for range data {
+		}
+		d.mux.Lock()
+		defer d.mux.Unlock()
+
+		d.files[fp] = &plannedFile{objType: objType, reason: "data is exported"}
+		return nil
+	}
+	f, err := os.Create(fp)
+	if err != nil {
+		return fmt.Errorf("Unable to create file %s: %s", fp, err)
+	}
+	defer f.Close()
+	for d := range data {
+		_, err = f.Write(d)
+		if err != nil {
+			return fmt.Errorf("Unable to write to file %s: %s", fp, err)
+		}
+	}
+	return nil
+}
+
+// This removes the file or directory
+func (r *backupRun) removePath(fp, objType, reason string) error {
+	d := r.dry()
+	if d == nil {
+		return os.RemoveAll(fp)
+	}
+	d.mux.Lock()
+	defer d.mux.Unlock()
+
+	d.removed[fp] = &plannedFile{objType: objType, reason: reason}
+	return nil
+}
+
+func (r *backupRun) renamePath(from, to, objType, reason string) error {
+	d := r.dry()
+	if d == nil {
+		return os.Rename(from, to)
+	}
+	d.mux.Lock()
+	defer d.mux.Unlock()
+
+	d.removed[from] = &plannedFile{objType: objType, reason: reason}
+	d.files[to] = &plannedFile{objType: objType, reason: reason}
+	return nil
+}
+
+func (r *backupRun) makeDir(dir string) {
+	if r.dry() == nil {
+		os.MkdirAll(dir, os.ModePerm)
+	}
+}
+
+// This returns the run's dry run or nil if it isn't one
+func (r *backupRun) dry() *dryRun {
+	if r == nil {
+		return nil
+	}
+	return r.dryRun
+}
+
+// This returns the changes the dry run would have made
+func (d *dryRun) changes() []FileChange {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+
+	var changes []FileChange
+	for fp, f := range d.files {
+		change := FileChange{Path: d.relPath(fp), Object: f.objType, Reason: f.reason}
+		existing, err := ioutil.ReadFile(fp)
+		if os.IsNotExist(err) {
+			change.Change = CREATED
+			if change.Reason == "" {
+				change.Reason = "not backed up before"
+			}
+		} else if !f.known || !bytes.Equal(existing, f.content) {
+			change.Change = MODIFIED
+			if change.Reason == "" {
+				change.Reason = "changed since the last backup"
+			}
+		} else {
+			continue // Unchanged
+		}
+		changes = append(changes, change)
+	}
+
+REMOVED:
+	for fp, f := range d.removed {
+		if _, err := os.Stat(fp); err != nil {
+			continue
+		}
+		// The removal of a directory covers everything under it
+		for dir := range d.removed {
+			if strings.HasPrefix(fp, dir+string(filepath.Separator)) {
+				continue REMOVED
+			}
+		}
+		changes = append(changes, FileChange{
+			Path:   d.relPath(fp),
+			Change: REMOVED,
+			Object: f.objType,
+			Reason: f.reason,
+		})
+	}
+
+	sort.Slice(changes, func(i, j int) bool {
+		if changes[i].Path != changes[j].Path {
+			return changes[i].Path < changes[j].Path
+		}
+		return changes[i].Change < changes[j].Change
+	})
+	return changes
+}
+
+func (d *dryRun) relPath(fp string) string {
+	rel, err := filepath.Rel(d.dst, fp)
+	if err != nil {
+		return fp
+	}
+	return rel
+}
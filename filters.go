@@ -0,0 +1,107 @@
+package backup
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/GrantStreetGroup/go-exasol-client"
+)
+
+// On top of the Match/Skip criteria schema objects can be filtered by their
+// owner and by when they were last changed. Like skipped objects the files
+// of filtered out objects are left as they are, so that an incremental
+// backup only rewrites the objects changed since the previous one.
+// Objects without an owner or last commit time aren't filtered out.
+
+const catalogTimeFormat = "YYYY-MM-DD HH24:MI:SS.FF3"
+
+type objectFilter struct {
+	owner         string // Comma delimited wildcard patterns
+	modifiedSince string // An SQL timestamp
+	excluded      map[string]map[string]bool
+	mux           sync.Mutex
+}
+
+// The Exasol object type of each type of schema object backed up
+var filteredObjectTypes = map[string]string{
+	"schemas":   "SCHEMA",
+	"tables":    "TABLE",
+	"views":     "VIEW",
+	"scripts":   "SCRIPT",
+	"functions": "FUNCTION",
+}
+
+// This returns nil if there is no owner or modified-since filter
+func newObjectFilter(owner, modifiedSince string) *objectFilter {
+	if owner == "" && modifiedSince == "" {
+		return nil
+	}
+	return &objectFilter{
+		owner:         owner,
+		modifiedSince: modifiedSince,
+		excluded:      map[string]map[string]bool{},
+	}
+}
+
+// This finds the objects of the given type ("tables", "views", etc.)
+// within the criteria which are filtered out.
+func (f *objectFilter) load(conn *exasol.Conn, objType string, crit Criteria) error {
+	if f == nil {
+		return nil
+	}
+	var conds []string
+	if f.owner != "" {
+		patterns, err := parsePatterns(f.owner, 1)
+		if err != nil {
+			return err
+		}
+		var owners []string
+		for _, p := range patterns {
+			owners = append(owners, p.name(0).sql("owner"))
+		}
+		conds = append(conds, "COALESCE("+strings.Join(owners, " OR ")+", TRUE)")
+	}
+	if f.modifiedSince != "" {
+		conds = append(conds, fmt.Sprintf("COALESCE(last_commit >= %s, TRUE)", f.modifiedSince))
+	}
+	sql := fmt.Sprintf(`
+		SELECT CASE WHEN object_type = 'SCHEMA' THEN object_name ELSE root_name END AS s,
+			   object_name AS o
+		FROM exa_all_objects
+		WHERE object_type = '%s'
+		  AND (%s)
+		  AND NOT (%s)
+		`, filteredObjectTypes[objType], crit.getSQLCriteria(),
+		strings.Join(conds, " AND "),
+	)
+	res, err := conn.FetchSlice(sql)
+	if err != nil {
+		return fmt.Errorf("Unable to filter %s: %s", objType, err)
+	}
+	excluded := map[string]bool{}
+	for _, row := range res {
+		o := row[1].(string)
+		if filteredObjectTypes[objType] == "SCHEMA" {
+			o = ""
+		}
+		excluded[row[0].(string)+"."+o] = true
+	}
+
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	f.excluded[objType] = excluded
+	return nil
+}
+
+// This returns true if the object is filtered out
+// ("" is the object of a schema itself)
+func (f *objectFilter) excludes(objType, schema, object string) bool {
+	if f == nil {
+		return false
+	}
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	return f.excluded[objType][schema+"."+object]
+}
@@ -2,8 +2,6 @@ package backup
 
 import (
 	"fmt"
-	"io/ioutil"
-	"os"
 	"path/filepath"
 	"regexp"
 
@@ -22,13 +20,17 @@ func (f *function) Name() string   { return f.name }
 
 func BackupFunctions(src *exasol.Conn, dst string, crit Criteria, dropExtras bool) error {
 	log.Info("Backing up functions")
+	run := crit.state()
 
 	allFuncs, dbObjs, err := getFunctionsToBackup(src, crit)
 	if err != nil {
 		return err
 	}
 	if dropExtras {
-		removeExtraObjects("functions", dbObjs, dst, crit)
+		err = removeExtraObjects("functions", dbObjs, dst, crit)
+		if err != nil {
+			return err
+		}
 	}
 
 	if len(allFuncs) == 0 {
@@ -38,8 +40,8 @@ func BackupFunctions(src *exasol.Conn, dst string, crit Criteria, dropExtras boo
 
 	for _, f := range allFuncs {
 		dir := filepath.Join(dst, "schemas", f.schema, "functions")
-		os.MkdirAll(dir, os.ModePerm)
-		err = createFunction(dir, f)
+		run.makeDir(dir)
+		err = createFunction(dir, f, run)
 		if err != nil {
 			return err
 		}
@@ -63,6 +65,15 @@ func getFunctionsToBackup(conn *exasol.Conn, crit Criteria) ([]*function, []dbOb
 	if err != nil {
 		return nil, nil, fmt.Errorf("Unable to get functions to backup: %s", err)
 	}
+	skipped, err := getSkippedSchemas(conn)
+	if err != nil {
+		return nil, nil, err
+	}
+	filter := crit.state().objectFilter
+	err = filter.load(conn, "functions", crit)
+	if err != nil {
+		return nil, nil, err
+	}
 	functions := []*function{}
 	dbObjs := []dbObj{}
 	for _, row := range res {
@@ -74,13 +85,15 @@ func getFunctionsToBackup(conn *exasol.Conn, crit Criteria) ([]*function, []dbOb
 		if row[3] != nil {
 			f.comment = row[3].(string)
 		}
-		functions = append(functions, f)
 		dbObjs = append(dbObjs, f)
+		if !skipped[f.schema] && !filter.excludes("functions", f.schema, f.name) {
+			functions = append(functions, f)
+		}
 	}
 	return functions, dbObjs, nil
 }
 
-func createFunction(dst string, f *function) error {
+func createFunction(dst string, f *function, run *backupRun) error {
 	log.Infof("Backing up function %s.%s", f.schema, f.name)
 	fText := regexp.MustCompile(`(?s)/\s*$`).ReplaceAllString(f.text, "")
 	sql := fmt.Sprintf(
@@ -94,7 +107,7 @@ func createFunction(dst string, f *function) error {
 		)
 	}
 	file := filepath.Join(dst, f.name+".sql")
-	err := ioutil.WriteFile(file, []byte(sql), 0644)
+	err := run.writeFile(file, []byte(sql), "functions")
 	if err != nil {
 		return fmt.Errorf("Unable to backup function: %s", err)
 	}
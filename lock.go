@@ -0,0 +1,182 @@
+package backup
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+// This is an advisory lock preventing concurrent
+// backups from writing into the same destination.
+
+const lockFile = ".backup.lock"
+
+type destLock struct {
+	PID     int       `json:"pid"`
+	Host    string    `json:"host"`
+	Started time.Time `json:"started"`
+
+	fp string
+}
+
+// This acquires the lock on the destination. If it's held by another
+// backup then it's retried until the timeout expires. A lock is stale, and
+// is taken over, if it's held by a process that no longer exists on this
+// host or, if staleAge > 0, if it was taken longer than staleAge ago.
+func lockDestination(dst string, timeout, staleAge time.Duration) (*destLock, error) {
+	host, _ := os.Hostname()
+	l := &destLock{
+		PID:     os.Getpid(),
+		Host:    host,
+		Started: time.Now(),
+		fp:      filepath.Join(dst, lockFile),
+	}
+	content, err := json.Marshal(l)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to encode lock: %s", err)
+	}
+
+	deadline := time.Now().Add(timeout)
+	for {
+		f, err := os.OpenFile(l.fp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err == nil {
+			_, err = f.Write(content)
+			f.Close()
+			if err != nil {
+				os.Remove(l.fp)
+				return nil, fmt.Errorf("Unable to write lock %s: %s", l.fp, err)
+			}
+			return l, nil
+		} else if !os.IsExist(err) {
+			return nil, fmt.Errorf("Unable to create lock %s: %s", l.fp, err)
+		}
+
+		holder, err := readLock(l.fp)
+		if os.IsNotExist(err) {
+			continue // It was just released
+		} else if err != nil {
+			return nil, err
+		}
+		if holder.isStale(host, staleAge) {
+			log.Warningf(
+				"Removing stale lock held by PID %d on %s since %s",
+				holder.PID, holder.Host, holder.Started.Format(time.RFC3339),
+			)
+			err = removeStaleLock(l.fp, holder)
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf(
+				"The Destination is locked by another backup (PID %d on %s since %s). "+
+					"If that backup is no longer running remove %s",
+				holder.PID, holder.Host, holder.Started.Format(time.RFC3339), l.fp,
+			)
+		}
+		log.Infof("Waiting for the backup by PID %d on %s to finish", holder.PID, holder.Host)
+		time.Sleep(time.Second)
+	}
+}
+
+func readLock(fp string) (*destLock, error) {
+	content, err := ioutil.ReadFile(fp)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("Unable to read lock %s: %s", fp, err)
+	}
+	l := &destLock{}
+	err = json.Unmarshal(content, l)
+	if err != nil {
+		// The lock may be read while its holder is still writing it, or it
+		// may have been left half written, so it's aged by its file instead.
+		info, err := os.Stat(fp)
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil, err
+			}
+			return nil, fmt.Errorf("Unable to read lock %s: %s", fp, err)
+		}
+		l.Started = info.ModTime()
+	}
+	return l, nil
+}
+
+func (l *destLock) isStale(host string, staleAge time.Duration) bool {
+	if staleAge > 0 && time.Since(l.Started) > staleAge {
+		return true
+	}
+	if l.Host != host || l.PID == 0 {
+		return false
+	}
+	proc, err := os.FindProcess(l.PID)
+	if err != nil {
+		return true
+	}
+	err = proc.Signal(syscall.Signal(0))
+	return err != nil && !errors.Is(err, syscall.EPERM)
+}
+
+// Rather than being removed, which could remove a new lock taken by another
+// backup which also found it stale, the stale lock is first renamed to a
+// name unique to this process. Only one of the backups can do so and the
+// others then find no lock or the new one.
+func removeStaleLock(fp string, stale *destLock) error {
+	tmp := fmt.Sprintf("%s.stale.%d.%d", fp, os.Getpid(), time.Now().UnixNano())
+	err := os.Rename(fp, tmp)
+	if os.IsNotExist(err) {
+		return nil // Another backup got there first
+	} else if err != nil {
+		return fmt.Errorf("Unable to remove stale lock %s: %s", fp, err)
+	}
+	defer os.Remove(tmp)
+
+	renamed, err := readLock(tmp)
+	if err == nil && !renamed.sameAs(stale) {
+		// It was replaced after being found stale so put it back
+		// unless yet another lock has been taken since.
+		err = os.Link(tmp, fp)
+		if err != nil && !os.IsExist(err) {
+			return fmt.Errorf("Unable to restore lock %s: %s", fp, err)
+		}
+	}
+	return nil
+}
+
+func (l *destLock) sameAs(o *destLock) bool {
+	return l.PID == o.PID && l.Host == o.Host && l.Started.Equal(o.Started)
+}
+
+// This removes the lock unless it has been taken over by another backup
+func (l *destLock) release() {
+	if l == nil {
+		return
+	}
+	holder, err := readLock(l.fp)
+	if os.IsNotExist(err) {
+		log.Warningf("The lock %s was removed by another process", l.fp)
+		return
+	} else if err != nil {
+		log.Error(err)
+		return
+	}
+	if !holder.sameAs(l) {
+		log.Warningf(
+			"The lock %s was taken over by PID %d on %s so it's left in place",
+			l.fp, holder.PID, holder.Host,
+		)
+		return
+	}
+	err = os.Remove(l.fp)
+	if err != nil {
+		log.Errorf("Unable to remove lock %s: %s", l.fp, err)
+	}
+}
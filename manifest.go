@@ -0,0 +1,296 @@
+package backup
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/GrantStreetGroup/go-exasol-client"
+)
+
+// The manifest records how the backup was taken so that
+// the data files can be correctly interpreted and restored.
+
+const manifestFile = "manifest.json"
+
+// The session settings the data was exported with are also written as
+// ALTER SESSION statements which are to be run before importing the data.
+const sessionFile = "session.sql"
+
+// These are the session parameters affecting the CSV representation of values
+var sessionParams = []string{
+	"NLS_DATE_FORMAT",
+	"NLS_DATE_LANGUAGE",
+	"NLS_NUMERIC_CHARACTERS",
+	"NLS_TIMESTAMP_FORMAT",
+	"TIME_ZONE",
+	"TIME_ZONE_BEHAVIOR",
+}
+
+type manifest struct {
+	Started  time.Time             `json:"started"`
+	Finished time.Time             `json:"finished"`
+	Tables   map[string]*dataEntry `json:"tables"`
+	Views    map[string]*dataEntry `json:"views"`
+	// The session settings affecting how the data was formatted
+	Session map[string]string `json:"session,omitempty"`
+	// The catalog snapshot the backup was read from (if any)
+	Snapshot *snapshot `json:"snapshot,omitempty"`
+	// The database time at which the backup started reading the catalog
+	CatalogTime string `json:"catalog_time,omitempty"`
+
+	dst      string
+	previous *manifest // As left by the previous backup
+	mux      sync.Mutex
+}
+
+type snapshot struct {
+	// The session whose read transaction the backup was taken in
+	Session string `json:"session"`
+	// The database time at which the transaction started
+	Started string `json:"started"`
+	// The most recent commit to any object as of the snapshot
+	LastCommit string `json:"last_commit,omitempty"`
+}
+
+type dataEntry struct {
+	Schema string    `json:"schema"`
+	Name   string    `json:"name"`
+	File   string    `json:"file"`
+	Format CSVFormat `json:"format"`
+	// The predicate restricting which rows were backed up (if any)
+	Filter string `json:"filter,omitempty"`
+	// The masked columns and how they were masked
+	Masked map[string]string `json:"masked,omitempty"`
+	// Whether only a sample of the rows was backed up
+	Sample bool `json:"sample,omitempty"`
+	// Fingerprint of the data used to skip re-exporting unchanged data
+	Fingerprint string `json:"fingerprint,omitempty"`
+	// The value each identity column is to be set to after loading the data
+	Identities map[string]string `json:"identities,omitempty"`
+}
+
+// This reads the manifest left by the previous backup (if any)
+// so that entries for objects outside of this run's scope are retained.
+func loadManifest(dst string) (*manifest, error) {
+	m := &manifest{
+		Tables: map[string]*dataEntry{},
+		Views:  map[string]*dataEntry{},
+	}
+	fp := filepath.Join(dst, manifestFile)
+	// If there's no manifest yet this is the first backup with one
+	content, err := ioutil.ReadFile(fp)
+	if err == nil {
+		err = json.Unmarshal(content, m)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to parse manifest %s: %s", fp, err)
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, fmt.Errorf("Unable to read manifest %s: %s", fp, err)
+	}
+	if m.Tables == nil {
+		m.Tables = map[string]*dataEntry{}
+	}
+	if m.Views == nil {
+		m.Views = map[string]*dataEntry{}
+	}
+	m.Started = time.Now()
+	m.Finished = time.Time{}
+	m.Snapshot = nil
+	m.dst = dst
+
+	m.previous = &manifest{
+		Tables:      map[string]*dataEntry{},
+		Views:       map[string]*dataEntry{},
+		CatalogTime: m.CatalogTime,
+	}
+	for k, e := range m.Tables {
+		m.previous.Tables[k] = e
+	}
+	for k, e := range m.Views {
+		m.previous.Views[k] = e
+	}
+	return m, nil
+}
+
+func (m *manifest) write(run *backupRun, dst string) error {
+	if m == nil {
+		return nil
+	}
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	m.Finished = time.Now()
+	content, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return fmt.Errorf("Unable to encode manifest: %s", err)
+	}
+	fp := filepath.Join(dst, manifestFile)
+	err = run.writeFile(fp, append(content, '\n'), "manifest")
+	if err != nil {
+		return fmt.Errorf("Unable to write manifest %s: %s", fp, err)
+	}
+
+	if len(m.Session) == 0 {
+		return nil
+	}
+	var sql string
+	for _, name := range sessionParams {
+		if value, ok := m.Session[name]; ok {
+			sql += fmt.Sprintf("ALTER SESSION SET %s='%s';\n", name, qStr(value))
+		}
+	}
+	fp = filepath.Join(dst, sessionFile)
+	err = run.writeFile(fp, []byte(sql), "session")
+	if err != nil {
+		return fmt.Errorf("Unable to write session settings %s: %s", fp, err)
+	}
+	return nil
+}
+
+// This records the database's current time. Objects changed
+// after it are changed since the backup (see Conf.Incremental).
+func (m *manifest) recordCatalogTime(conn *exasol.Conn) error {
+	if m == nil {
+		return nil
+	}
+	sql := fmt.Sprintf(`SELECT TO_CHAR(SYSTIMESTAMP, '%s')`, catalogTimeFormat)
+	res, err := conn.FetchSlice(sql)
+	if err != nil {
+		return fmt.Errorf("Unable to get the catalog time: %s", err)
+	}
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	m.CatalogTime = res[0][0].(string)
+	return nil
+}
+
+// This returns the catalog time of the previous backup (if any)
+func (m *manifest) previousCatalogTime() string {
+	if m == nil || m.previous == nil {
+		return ""
+	}
+	return m.previous.CatalogTime
+}
+
+// This records the identity of the transaction the catalog is being read in
+func (m *manifest) recordSnapshot(conn *exasol.Conn) error {
+	if m == nil {
+		return nil
+	}
+	sql := `
+		SELECT CAST(CURRENT_SESSION AS VARCHAR(20)),
+			   CAST(CURRENT_TIMESTAMP AS VARCHAR(40)),
+			   CAST(MAX(last_commit) AS VARCHAR(40))
+		FROM exa_all_object_sizes
+	`
+	res, err := conn.FetchSlice(sql)
+	if err != nil {
+		return fmt.Errorf("Unable to get snapshot: %s", err)
+	}
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	m.Snapshot = &snapshot{
+		Session: res[0][0].(string),
+		Started: res[0][1].(string),
+	}
+	if res[0][2] != nil {
+		m.Snapshot.LastCommit = res[0][2].(string)
+	}
+	return nil
+}
+
+// This records the connection's current session settings
+// which affect how the exported data is formatted.
+func (m *manifest) recordSession(conn *exasol.Conn) error {
+	if m == nil {
+		return nil
+	}
+	sql := fmt.Sprintf(`
+		SELECT parameter_name, session_value
+		FROM exa_parameters
+		WHERE parameter_name IN ('%s')
+		`, strings.Join(sessionParams, "','"),
+	)
+	res, err := conn.FetchSlice(sql)
+	if err != nil {
+		return fmt.Errorf("Unable to get session settings: %s", err)
+	}
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	m.Session = map[string]string{}
+	for _, row := range res {
+		if row[1] != nil {
+			m.Session[row[0].(string)] = row[1].(string)
+		}
+	}
+	return nil
+}
+
+// This removes the data entries of the given object type ("tables" or "views")
+// which fall within the criteria. They are re-added as the data is backed up.
+// The entries of the objects within the criteria (dbObjs) which aren't being
+// backed up (selected), e.g. due to an annotation or filter, are kept as
+// their files are left as they are.
+func (m *manifest) resetData(objType string, crit Criteria, dbObjs []dbObj, selected map[string]bool) {
+	if m == nil {
+		return
+	}
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	kept := map[string]bool{}
+	for _, o := range dbObjs {
+		key := o.Schema() + "." + o.Name()
+		if !selected[key] {
+			kept[key] = true
+		}
+	}
+	entries := m.dataEntries(objType)
+	var names [][2]string
+	for _, e := range entries {
+		names = append(names, [2]string{e.Schema, e.Name})
+	}
+	crit.prefetch(names)
+	for key, e := range entries {
+		if crit.matches(e.Schema, e.Name) && !kept[key] {
+			delete(entries, key)
+		}
+	}
+}
+
+func (m *manifest) addData(objType string, e *dataEntry) {
+	if m == nil {
+		return
+	}
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	m.dataEntries(objType)[e.Schema+"."+e.Name] = e
+}
+
+// This returns the data entry recorded by the previous backup or nil
+func (m *manifest) previousData(objType, schema, name string) *dataEntry {
+	if m == nil || m.previous == nil {
+		return nil
+	}
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	return m.previous.dataEntries(objType)[schema+"."+name]
+}
+
+func (m *manifest) dataEntries(objType string) map[string]*dataEntry {
+	if objType == "views" {
+		return m.Views
+	}
+	return m.Tables
+}
@@ -0,0 +1,261 @@
+package backup
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"math/rand"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// This masks column values as they're exported so that
+// clear values of sensitive columns never leave the database.
+//
+// MASK_FAKE is obfuscation rather than masking: being a fixed substitution
+// of each character it can be reversed e.g. by frequency analysis. Use
+// MASK_HASH, MASK_NULL or MASK_CONSTANT for values which must stay secret.
+// Nor is it unique for DECIMAL columns, where a digit substituted by a
+// leading 0 is dropped, so it mustn't be used for keys.
+
+type MaskMethod byte
+
+const (
+	MASK_HASH     MaskMethod = iota + 1 // Salted SHA256 hex digest (character columns only)
+	MASK_NULL                           // Replace with NULL
+	MASK_CONSTANT                       // Replace non-NULL values with Mask.Value
+	MASK_FAKE                           // Format-preserving character substitution (reversible)
+	MASK_TRUNCATE                       // Keep the first Mask.Length characters
+)
+
+var maskMethodNames = map[MaskMethod]string{
+	MASK_HASH:     "hash",
+	MASK_NULL:     "null",
+	MASK_CONSTANT: "constant",
+	MASK_FAKE:     "fake",
+	MASK_TRUNCATE: "truncate",
+}
+
+type Mask struct {
+	Method MaskMethod
+	// For MASK_CONSTANT this is the replacement value. It is cast to the
+	// column's type so e.g. '2000-01-01' can be used for a DATE column.
+	// For MASK_HASH this is the (required) salt hashed along with each value
+	// so that low-entropy values can't be recovered with a dictionary.
+	// For MASK_FAKE this seeds the character substitution.
+	Value string
+	// For MASK_TRUNCATE this is the (positive) number of characters to keep
+	Length int
+}
+
+func (m MaskMethod) String() string {
+	return maskMethodNames[m]
+}
+
+// This checks that the masks have the settings their methods require
+func validateMasks(masks map[string]Mask) error {
+	for p, m := range masks {
+		switch {
+		case maskMethodNames[m.Method] == "":
+			return fmt.Errorf("Invalid mask for %s: unknown masking method %d", p, m.Method)
+		case m.Method == MASK_HASH && m.Value == "":
+			return fmt.Errorf("Invalid mask for %s: hash masking requires a salt Value", p)
+		case m.Method == MASK_TRUNCATE && m.Length < 1:
+			return fmt.Errorf("Invalid mask for %s: truncate masking requires a Length of at least 1", p)
+		}
+	}
+	return nil
+}
+
+// This returns the mask for the column or nil if it isn't masked.
+// If several "schema.table.column" patterns match the longest one wins.
+func (d DataConf) columnMask(schema, object, col string) *Mask {
+	var patterns []string
+	for p := range d.Masks {
+		patterns = append(patterns, p)
+	}
+	sort.Slice(patterns, func(i, j int) bool {
+		if len(patterns[i]) != len(patterns[j]) {
+			return len(patterns[i]) > len(patterns[j])
+		}
+		return patterns[i] < patterns[j]
+	})
+	for _, p := range patterns {
+		if matchesColumnPattern(p, schema, object, col) {
+			mask := d.Masks[p]
+			return &mask
+		}
+	}
+	return nil
+}
+
+// This returns the SELECT list used to export the given columns along with
+// the masked column names and their masking methods. If no column is masked
+// or needs formatting then "*" is returned.
+func (d DataConf) selectList(schema, object string, cols []*column) (string, map[string]string, error) {
+	var exprs []string
+	masked := map[string]string{}
+	formatted := false
+	for _, c := range cols {
+		mask := d.columnMask(schema, object, c.name)
+		if mask == nil {
+			if expr := timestampExpression(c); expr != "" {
+				exprs = append(exprs, fmt.Sprintf("%s AS [%s]", expr, qExportIdent(c.name)))
+				formatted = true
+				continue
+			}
+			exprs = append(exprs, fmt.Sprintf("[%s]", qExportIdent(c.name)))
+			continue
+		}
+		expr, err := mask.expression(c)
+		if err != nil {
+			return "", nil, fmt.Errorf(
+				"Unable to mask column %s.%s.%s: %s",
+				schema, object, c.name, err,
+			)
+		}
+		exprs = append(exprs, fmt.Sprintf("%s AS [%s]", expr, qExportIdent(c.name)))
+		masked[c.name] = mask.Method.String()
+	}
+	if len(masked) == 0 && !formatted {
+		return "*", nil, nil
+	}
+	if len(masked) == 0 {
+		masked = nil
+	}
+	return strings.Join(exprs, ", "), masked, nil
+}
+
+// The session's timestamp format only has millisecond precision so
+// timestamps of any other precision are formatted explicitly in order
+// to export them at their full precision. If the session format
+// suffices then "" is returned.
+func timestampExpression(c *column) string {
+	if !strings.HasPrefix(c.colType, "TIMESTAMP") || c.scale == 3 {
+		return ""
+	}
+	format := "YYYY-MM-DD HH24:MI:SS"
+	if c.scale > 0 {
+		format += fmt.Sprintf(".FF%d", c.scale)
+	}
+	return fmt.Sprintf("TO_CHAR([%s], '%s')", qExportIdent(c.name), format)
+}
+
+// This returns the column_num_scale of a TIMESTAMP column. Versions of
+// Exasol without fractional second precision have millisecond precision.
+func timestampScale(scale interface{}) int {
+	if f, ok := scale.(float64); ok {
+		return int(f)
+	}
+	return 3
+}
+
+func (m *Mask) expression(c *column) (string, error) {
+	col := fmt.Sprintf("[%s]", qExportIdent(c.name))
+	length, isChar := charLength(c.colType)
+
+	switch m.Method {
+	case MASK_HASH:
+		if !isChar {
+			return "", fmt.Errorf("hash masking requires a character column not %s", c.colType)
+		}
+		expr := fmt.Sprintf("HASH_SHA256('%s' || %s)", qExportStr(m.Value), col)
+		if length < 64 {
+			expr = fmt.Sprintf("SUBSTR(%s, 1, %d)", expr, length)
+		}
+		return fmt.Sprintf("CASE WHEN %s IS NULL THEN NULL ELSE %s END", col, expr), nil
+
+	case MASK_NULL:
+		return fmt.Sprintf("CAST(NULL AS %s)", c.colType), nil
+
+	case MASK_CONSTANT:
+		return fmt.Sprintf(
+			"CASE WHEN %s IS NULL THEN NULL ELSE CAST('%s' AS %s) END",
+			col, qExportStr(m.Value), c.colType,
+		), nil
+
+	case MASK_FAKE:
+		from, to := fakeSubstitution(m.Value)
+		if isChar {
+			return fmt.Sprintf("TRANSLATE(%s, '%s', '%s')", col, from, to), nil
+		}
+		if strings.HasPrefix(c.colType, "DECIMAL") {
+			// Only substitute digits so that the result is still a number.
+			// Leading zeros are lost so distinct values may collide.
+			return fmt.Sprintf(
+				"CAST(TRANSLATE(TO_CHAR(%s), '%s', '%s') AS %s)",
+				col, from[:10], to[:10], c.colType,
+			), nil
+		}
+		return "", fmt.Errorf("fake masking requires a character or decimal column not %s", c.colType)
+
+	case MASK_TRUNCATE:
+		if !isChar {
+			return "", fmt.Errorf("truncate masking requires a character column not %s", c.colType)
+		}
+		return fmt.Sprintf("SUBSTR(%s, 1, %d)", col, m.Length), nil
+	}
+	return "", fmt.Errorf("unknown masking method %d", m.Method)
+}
+
+// This returns a deterministic, seeded substitution of digits and letters.
+// Digits map to digits and letters to letters of the same case so the
+// format of the value is preserved. It's a bijection so it can be inverted
+// by anyone who knows, or can guess, the seed.
+func fakeSubstitution(seed string) (string, string) {
+	sum := sha256.Sum256([]byte(seed))
+	var n int64
+	for _, b := range sum[:8] {
+		n = n<<8 | int64(b)
+	}
+	rnd := rand.New(rand.NewSource(n))
+
+	var from, to string
+	for _, set := range []string{
+		"0123456789",
+		"abcdefghijklmnopqrstuvwxyz",
+		"ABCDEFGHIJKLMNOPQRSTUVWXYZ",
+	} {
+		shuffled := []byte(set)
+		rnd.Shuffle(len(shuffled), func(i, j int) {
+			shuffled[i], shuffled[j] = shuffled[j], shuffled[i]
+		})
+		from += set
+		to += string(shuffled)
+	}
+	return from, to
+}
+
+var typeLengthRegexp = regexp.MustCompile(`\((\d+)\)`)
+
+// This returns the length of a CHAR/VARCHAR column type
+// and whether or not it is a character type at all.
+func charLength(colType string) (int, bool) {
+	if !strings.HasPrefix(colType, "CHAR") && !strings.HasPrefix(colType, "VARCHAR") {
+		return 0, false
+	}
+	m := typeLengthRegexp.FindStringSubmatch(colType)
+	if m == nil {
+		return 0, true
+	}
+	length, _ := strconv.Atoi(m[1])
+	return length, true
+}
+
+// This checks a "schema.table.column" wildcard pattern (or a comma
+// delimited list of them) against the given column. A missing part
+// is assumed to be "*".
+func matchesColumnPattern(patternStr, schema, object, col string) bool {
+	patterns, err := parsePatterns(patternStr, 3)
+	if err != nil {
+		log.Error(err)
+		return false
+	}
+	for _, p := range patterns {
+		if p.matches(schema, object, col) {
+			return true
+		}
+	}
+	return false
+}
@@ -2,8 +2,6 @@ package backup
 
 import (
 	"fmt"
-	"io/ioutil"
-	"os"
 	"path/filepath"
 
 	"github.com/GrantStreetGroup/go-exasol-client"
@@ -16,7 +14,7 @@ type parameter struct {
 	value string
 }
 
-func BackupParameters(src *exasol.Conn, dst string) error {
+func BackupParameters(src *exasol.Conn, dst string, run *backupRun) error {
 	log.Info("Backing up parameters")
 
 	parameters, err := getParametersToBackup(src)
@@ -33,9 +31,9 @@ func BackupParameters(src *exasol.Conn, dst string) error {
 		sql += createParameter(parameter)
 	}
 
-	os.MkdirAll(dst, os.ModePerm)
+	run.makeDir(dst)
 	file := filepath.Join(dst, "parameters.sql")
-	err = ioutil.WriteFile(file, []byte(sql), 0644)
+	err = run.writeFile(file, []byte(sql), "parameters")
 	if err != nil {
 		return fmt.Errorf("Unable to backup parameters: %s", err)
 	}
@@ -0,0 +1,317 @@
+package backup
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// This parses the comma delimited "schema.object" wildcard patterns used
+// by Match, Skip and the other configs into a form from which both the Go
+// matchers and safely escaped SQL are produced.
+//
+// A "*" matches any number of characters. Names containing dots, commas,
+// asterisks, etc. can be double quoted as in SQL e.g. "my.schema".*
+// (with "" being a literal double quote) or have those characters escaped
+// with a backslash e.g. my\.schema.*. Whitespace around each name is
+// ignored unless quoted or escaped. Matching is always case-insensitive.
+
+type pattern struct {
+	names []glob // e.g. schema, object. Missing trailing names match anything
+	res   []*regexp.Regexp
+}
+
+// A glob is a single name made up of literal text and wildcards
+type glob []globToken
+
+type globToken struct {
+	literal  string
+	wildcard bool
+}
+
+var parsedPatterns sync.Map // Of the strings parsed so far
+
+// This parses the comma delimited patterns each
+// having up to the given number of dot delimited names
+func parsePatterns(str string, maxNames int) ([]*pattern, error) {
+	key := fmt.Sprintf("%d:%s", maxNames, str)
+	if p, ok := parsedPatterns.Load(key); ok {
+		return p.([]*pattern), nil
+	}
+	patterns, err := parseGlobs([]rune(str), maxNames)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to parse pattern %q: %s", str, err)
+	}
+	parsedPatterns.Store(key, patterns)
+	return patterns, nil
+}
+
+func parseGlobs(runes []rune, maxNames int) ([]*pattern, error) {
+	var patterns []*pattern
+	var names []glob
+	var cur glob
+	var protected []bool // Per token whether it's quoted or escaped
+
+	endName := func() error {
+		cur, protected = trimGlob(cur, protected)
+		if len(cur) == 0 {
+			return errors.New("a name is empty")
+		}
+		names = append(names, cur.merged())
+		cur, protected = nil, nil
+		if len(names) > maxNames {
+			return fmt.Errorf("there are more than %d dot delimited names", maxNames)
+		}
+		return nil
+	}
+	endPattern := func() error {
+		err := endName()
+		if err != nil {
+			return err
+		}
+		p := &pattern{names: names}
+		for _, g := range names {
+			p.res = append(p.res, g.compile())
+		}
+		patterns = append(patterns, p)
+		names = nil
+		return nil
+	}
+
+	for i := 0; i < len(runes); i++ {
+		switch runes[i] {
+		case '"':
+			var lit []rune
+			for {
+				i++
+				if i >= len(runes) {
+					return nil, errors.New("a quote is unterminated")
+				}
+				if runes[i] == '"' {
+					if i+1 >= len(runes) || runes[i+1] != '"' {
+						break
+					}
+					i++
+				}
+				lit = append(lit, runes[i])
+			}
+			if len(lit) == 0 {
+				return nil, errors.New("a quoted name is empty")
+			}
+			cur = append(cur, globToken{literal: string(lit)})
+			protected = append(protected, true)
+		case '\\':
+			i++
+			if i >= len(runes) {
+				return nil, errors.New("it ends with an escape")
+			}
+			cur = append(cur, globToken{literal: string(runes[i])})
+			protected = append(protected, true)
+		case '*':
+			cur = append(cur, globToken{wildcard: true})
+			protected = append(protected, false)
+		case '.':
+			err := endName()
+			if err != nil {
+				return nil, err
+			}
+		case ',':
+			err := endPattern()
+			if err != nil {
+				return nil, err
+			}
+		default:
+			cur = append(cur, globToken{literal: string(runes[i])})
+			protected = append(protected, false)
+		}
+	}
+	err := endPattern()
+	if err != nil {
+		return nil, err
+	}
+	return patterns, nil
+}
+
+// This removes the unprotected whitespace around the name
+func trimGlob(g glob, protected []bool) (glob, []bool) {
+	isSpace := func(i int) bool {
+		return !protected[i] && !g[i].wildcard &&
+			strings.TrimFunc(g[i].literal, unicode.IsSpace) == ""
+	}
+	for len(g) > 0 && isSpace(0) {
+		g, protected = g[1:], protected[1:]
+	}
+	for len(g) > 0 && isSpace(len(g)-1) {
+		g, protected = g[:len(g)-1], protected[:len(protected)-1]
+	}
+	return g, protected
+}
+
+// This joins adjacent literals and adjacent wildcards
+func (g glob) merged() glob {
+	var m glob
+	for _, t := range g {
+		last := len(m) - 1
+		if last >= 0 && t.wildcard && m[last].wildcard {
+			continue
+		}
+		if last >= 0 && !t.wildcard && !m[last].wildcard {
+			m[last].literal += t.literal
+			continue
+		}
+		m = append(m, t)
+	}
+	return m
+}
+
+// This returns true if the glob matches anything
+func (g glob) matchesAll() bool {
+	return len(g) == 1 && g[0].wildcard
+}
+
+// This compiles the glob into a regexp matching upper-cased names.
+// Like UPPER() in the SQL this makes the match case-insensitive.
+func (g glob) compile() *regexp.Regexp {
+	var re strings.Builder
+	re.WriteString("(?s)^")
+	for _, t := range g {
+		if t.wildcard {
+			re.WriteString(".*")
+		} else {
+			re.WriteString(regexp.QuoteMeta(strings.ToUpper(t.literal)))
+		}
+	}
+	re.WriteString("$")
+	return regexp.MustCompile(re.String())
+}
+
+// This returns the glob as a LIKE pattern escaped with a backslash
+func (g glob) likePattern() string {
+	var like strings.Builder
+	for _, t := range g {
+		if t.wildcard {
+			like.WriteString("%")
+			continue
+		}
+		for _, r := range t.literal {
+			if r == '%' || r == '_' || r == '\\' {
+				like.WriteRune('\\')
+			}
+			like.WriteRune(r)
+		}
+	}
+	return like.String()
+}
+
+// This returns a SQL condition checking the column against the glob
+func (g glob) sql(col string) string {
+	return fmt.Sprintf(
+		`UPPER(%s) LIKE UPPER('%s') ESCAPE '\'`,
+		col, qStr(g.likePattern()),
+	)
+}
+
+// This returns the glob in the pattern syntax
+func (g glob) String() string {
+	var str strings.Builder
+	for _, t := range g {
+		if t.wildcard {
+			str.WriteString("*")
+		} else if strings.ContainsAny(t.literal, `".,*\`) ||
+			strings.TrimFunc(t.literal, unicode.IsSpace) != t.literal {
+			str.WriteString(`"` + strings.Replace(t.literal, `"`, `""`, -1) + `"`)
+		} else {
+			str.WriteString(t.literal)
+		}
+	}
+	return str.String()
+}
+
+// This returns the name at the given index or,
+// if the pattern doesn't have that many names, "*".
+func (p *pattern) name(i int) glob {
+	if i < len(p.names) {
+		return p.names[i]
+	}
+	return glob{{wildcard: true}}
+}
+
+// This checks the names (e.g. schema and object) against the pattern
+func (p *pattern) matches(names ...string) bool {
+	for i, name := range names {
+		if i < len(p.res) && !p.res[i].MatchString(strings.ToUpper(name)) {
+			return false
+		}
+	}
+	return true
+}
+
+func (p *pattern) String() string {
+	var names []string
+	for _, g := range p.names {
+		names = append(names, g.String())
+	}
+	return strings.Join(names, ".")
+}
+
+// This returns a regexp criteria as a SQL string literal. The regexp
+// is anchored and case-insensitive just as in matchesCriteria().
+func regexpSQL(re string) string {
+	return "'" + qStr("(?i)^(?:"+re+")$") + "'"
+}
+
+// This checks that all of the wildcard patterns in the config can be parsed
+func validatePatterns(cfg Conf) error {
+	check := func(config, str string, maxNames int) error {
+		if str == "" {
+			return nil
+		}
+		_, err := parsePatterns(str, maxNames)
+		if err != nil {
+			return fmt.Errorf("Invalid %s: %s", config, err)
+		}
+		return nil
+	}
+	var errs []error
+	if !cfg.RegexpMatch {
+		errs = append(errs, check("Match", cfg.Match, 2), check("Skip", cfg.Skip, 2))
+	}
+	// Global objects' patterns are never regexps
+	schemaObjects := map[Object]bool{
+		SCHEMAS: true, VIRTUAL_SCHEMAS: true, TABLES: true,
+		VIEWS: true, SCRIPTS: true, FUNCTIONS: true,
+	}
+	for o, tc := range cfg.TypeCriteria {
+		if cfg.RegexpMatch && schemaObjects[o] {
+			continue
+		}
+		// Global objects' names have only the one part
+		maxNames := 1
+		if schemaObjects[o] {
+			maxNames = 2
+		}
+		errs = append(errs,
+			check("TypeCriteria Match", tc.Match, maxNames),
+			check("TypeCriteria Skip", tc.Skip, maxNames),
+		)
+	}
+	errs = append(errs, check("DataMatch", cfg.DataMatch, 2), check("Owner", cfg.Owner, 1))
+	for p := range cfg.CSVFormats {
+		errs = append(errs, check("CSVFormats pattern", p, 2))
+	}
+	for p := range cfg.RowFilters {
+		errs = append(errs, check("RowFilters pattern", p, 2))
+	}
+	for p := range cfg.Masks {
+		errs = append(errs, check("Masks pattern", p, 3))
+	}
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
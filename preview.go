@@ -0,0 +1,317 @@
+package backup
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/GrantStreetGroup/go-exasol-client"
+)
+
+// This previews which schema objects a backup's criteria would include in,
+// or exclude from, the backup. The objects are selected by the same
+// routines as the backup itself so annotations and the owner and
+// modified-since filters are taken into account too.
+
+// ObjectMatch is the outcome of the criteria for a single schema object
+type ObjectMatch struct {
+	Schema   string
+	Object   string // "" for the schema itself
+	Type     string // e.g. "SCHEMA", "TABLE", "VIEW", "SCRIPT" or "FUNCTION"
+	Included bool
+	Rule     string // What decided whether it's included
+}
+
+type CriteriaPreview struct {
+	Objects []ObjectMatch
+	// Warnings about individual patterns not matching any object
+	Warnings []string
+}
+
+// The types of schema object previewed along with the name of each
+// used by the objectFilter and the query listing all of them.
+var previewTypes = []struct {
+	object  Object
+	name    string
+	objType string
+	sql     string
+}{
+	{SCHEMAS, "schemas", "SCHEMA", `
+		SELECT schema_name, ''
+		FROM exa_schemas
+		WHERE schema_is_virtual = FALSE
+		ORDER BY 1
+	`},
+	{TABLES, "tables", "TABLE", `
+		SELECT table_schema, table_name
+		FROM exa_all_tables
+		WHERE table_is_virtual = FALSE
+		ORDER BY 1, 2
+	`},
+	{VIEWS, "views", "VIEW", `
+		SELECT view_schema, view_name
+		FROM exa_all_views
+		ORDER BY 1, 2
+	`},
+	{SCRIPTS, "scripts", "SCRIPT", `
+		SELECT script_schema, script_name
+		FROM exa_all_scripts
+		ORDER BY 1, 2
+	`},
+	{FUNCTIONS, "functions", "FUNCTION", `
+		SELECT function_schema, function_name
+		FROM exa_all_functions
+		ORDER BY 1, 2
+	`},
+}
+
+// An individual pattern of the criteria
+type previewPattern struct {
+	config  string // e.g. "Match" or "TABLES Skip"
+	pattern string
+	regexp  bool
+	skip    bool
+}
+
+func (p previewPattern) String() string {
+	return fmt.Sprintf("%s pattern %q", p.config, p.pattern)
+}
+
+// PreviewCriteria lists the schema objects in the Source database and
+// whether a backup with the given config would include them. Only the
+// schema object types in Objects (or all of them if it's ALL or empty)
+// are listed. The configs selecting objects (Match, Skip, RegexpMatch,
+// CriteriaFile, TypeCriteria, Owner, ModifiedSince and Incremental) are
+// used as by Backup(). The Destination is only read for Incremental.
+func PreviewCriteria(cfg Conf) (*CriteriaPreview, error) {
+	err := initLogging(cfg.LogLevel)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Source == nil {
+		return nil, errors.New("You must specify a source Exasol connection")
+	}
+	conn := cfg.Source
+	run := &backupRun{regexpCache: newRegexpCache()}
+	critFor, _, err := configCriteria(cfg, run)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Incremental && cfg.Destination != "" {
+		run.manifest, err = loadManifest(cfg.Destination)
+		if err != nil {
+			return nil, err
+		}
+	}
+	run.objectFilter = newObjectFilter(cfg.Owner, modifiedSince(cfg, run.manifest))
+
+	preview := &CriteriaPreview{}
+	var patterns []previewPattern
+	matched := map[previewPattern]bool{}
+	for _, pt := range previewTypes {
+		if !previewed(cfg.Objects, pt.object) {
+			continue
+		}
+		crit := critFor(pt.object)
+		label := ""
+		if _, ok := cfg.TypeCriteria[pt.object]; ok {
+			label = strings.ToUpper(pt.name) + " "
+		}
+		critPatterns, err := criteriaPatterns(label, crit)
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range critPatterns {
+			if _, ok := matched[p]; !ok {
+				matched[p] = false
+				patterns = append(patterns, p)
+			}
+		}
+
+		res, err := conn.FetchSlice(pt.sql)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to get %s: %s", pt.name, err)
+		}
+		selected, within, err := getSelected(conn, pt.object, crit)
+		if err != nil {
+			return nil, err
+		}
+		var names, critNames [][2]string
+		for _, row := range res {
+			object, _ := row[1].(string) // Exasol returns '' as NULL
+			names = append(names, [2]string{row[0].(string), object})
+			if pt.object == SCHEMAS {
+				object = row[0].(string)
+			}
+			critNames = append(critNames, [2]string{row[0].(string), object})
+		}
+		crit.prefetch(critNames)
+
+		for _, n := range names {
+			om := ObjectMatch{Schema: n[0], Object: n[1], Type: pt.objType}
+			// Schemas are selected as their own objects (see getSchemasToBackup)
+			object := om.Object
+			if pt.object == SCHEMAS {
+				object = om.Schema
+			}
+			var matchedBy, skippedBy *previewPattern
+			for i, p := range critPatterns {
+				if !matchesCriteria(p.pattern, om.Schema, object, p.regexp, p.skip, conn, run.regexpCache) {
+					continue
+				}
+				matched[p] = true
+				switch {
+				case crit.rules != nil:
+					// The last matching line of a CriteriaFile decides
+					matchedBy, skippedBy = &critPatterns[i], nil
+					if p.skip {
+						skippedBy = matchedBy
+					}
+				case p.skip && skippedBy == nil:
+					skippedBy = &critPatterns[i]
+				case !p.skip && matchedBy == nil:
+					matchedBy = &critPatterns[i]
+				}
+			}
+
+			key := om.Schema + "." + om.Object
+			switch {
+			case selected[key]:
+				om.Included = true
+				om.Rule = "Match criteria"
+				if matchedBy != nil {
+					om.Rule = matchedBy.String()
+				}
+			case within[key]:
+				if run.objectFilter.excludes(pt.name, om.Schema, om.Object) {
+					om.Rule = "Owner/ModifiedSince filter"
+				} else {
+					om.Rule = skipAnnotation + " annotation"
+				}
+			case matchedBy != nil && skippedBy != nil:
+				om.Rule = skippedBy.String()
+			default:
+				om.Rule = "no Match pattern"
+			}
+			preview.Objects = append(preview.Objects, om)
+		}
+	}
+
+	for _, p := range patterns {
+		if !matched[p] {
+			preview.Warnings = append(preview.Warnings, fmt.Sprintf("%s matches nothing", p))
+		}
+	}
+	for _, w := range preview.Warnings {
+		log.Warning(w)
+	}
+	return preview, nil
+}
+
+// This returns true if the objects to backup include the given type
+func previewed(objects []Object, o Object) bool {
+	if len(objects) == 0 {
+		return true
+	}
+	for _, obj := range objects {
+		if obj == o || obj == ALL {
+			return true
+		}
+	}
+	return false
+}
+
+// This returns the "schema.object" names of the objects of the given type
+// that would be backed up (selected) and of those within the criteria but
+// skipped by an annotation or filtered out (within).
+func getSelected(conn *exasol.Conn, o Object, crit Criteria) (selected, within map[string]bool, err error) {
+	var objs, dbObjs []dbObj
+	switch o {
+	case SCHEMAS:
+		var schemas []*schema
+		schemas, dbObjs, err = getSchemasToBackup(conn, crit)
+		for _, s := range schemas {
+			objs = append(objs, s)
+		}
+	case TABLES:
+		var tables []*table
+		tables, dbObjs, err = getTablesToBackup(conn, crit)
+		for _, t := range tables {
+			objs = append(objs, t)
+		}
+	case VIEWS:
+		var views []*view
+		views, dbObjs, err = getViewsToBackup(conn, crit)
+		for _, v := range views {
+			objs = append(objs, v)
+		}
+	case SCRIPTS:
+		var scripts []*script
+		scripts, dbObjs, err = getScriptsToBackup(conn, crit)
+		for _, s := range scripts {
+			objs = append(objs, s)
+		}
+	case FUNCTIONS:
+		var functions []*function
+		functions, dbObjs, err = getFunctionsToBackup(conn, crit)
+		for _, f := range functions {
+			objs = append(objs, f)
+		}
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	selected = map[string]bool{}
+	for _, obj := range objs {
+		selected[obj.Schema()+"."+obj.Name()] = true
+	}
+	within = map[string]bool{}
+	for _, obj := range dbObjs {
+		within[obj.Schema()+"."+obj.Name()] = true
+	}
+	return selected, within, nil
+}
+
+// This splits the criteria into its individual patterns, those of a
+// CriteriaFile in the order of its lines. A regular expression is a
+// single pattern.
+func criteriaPatterns(label string, crit Criteria) ([]previewPattern, error) {
+	if crit.rules != nil {
+		var patterns []previewPattern
+		for _, r := range crit.rules {
+			config := label + "Match"
+			if r.Skip {
+				config = label + "Skip"
+			}
+			patterns = append(patterns, previewPattern{config, r.Pattern, r.Regexp, r.Skip})
+		}
+		return patterns, nil
+	}
+	patterns, err := splitPatterns(label+"Match", crit.match, crit.regexpMatch, false)
+	if err != nil {
+		return nil, err
+	}
+	skipPatterns, err := splitPatterns(label+"Skip", crit.skip, crit.regexpMatch, true)
+	if err != nil {
+		return nil, err
+	}
+	return append(patterns, skipPatterns...), nil
+}
+
+func splitPatterns(config, criteria string, regexpMatch, skip bool) ([]previewPattern, error) {
+	if criteria == "" {
+		return nil, nil
+	}
+	if regexpMatch {
+		return []previewPattern{{config, criteria, true, skip}}, nil
+	}
+	parsed, err := parsePatterns(criteria, 2)
+	if err != nil {
+		return nil, err
+	}
+	var patterns []previewPattern
+	for _, p := range parsed {
+		patterns = append(patterns, previewPattern{config, p.String(), false, skip})
+	}
+	return patterns, nil
+}
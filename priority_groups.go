@@ -2,9 +2,8 @@ package backup
 
 import (
 	"fmt"
-	"io/ioutil"
-	"os"
 	"path/filepath"
+	"regexp"
 
 	"github.com/GrantStreetGroup/go-exasol-client"
 )
@@ -17,10 +16,11 @@ type priorityGroup struct {
 	comment string
 }
 
-func BackupPriorityGroups(src *exasol.Conn, dst string) error {
+func BackupPriorityGroups(src *exasol.Conn, dst string, crit Criteria) error {
 	log.Info("Backing up priority groups")
+	run := crit.state()
 
-	priorityGroups, err := getPriorityGroupsToBackup(src)
+	priorityGroups, err := getPriorityGroupsToBackup(src, crit)
 	if err != nil {
 		return err
 	}
@@ -29,14 +29,14 @@ func BackupPriorityGroups(src *exasol.Conn, dst string) error {
 		return nil
 	}
 
-	var sql string
+	entries := map[string]string{}
 	for _, priorityGroup := range priorityGroups {
-		sql += createPriorityGroup(priorityGroup)
+		entries[priorityGroup.name] = createPriorityGroup(priorityGroup)
 	}
 
-	os.MkdirAll(dst, os.ModePerm)
+	run.makeDir(dst)
 	file := filepath.Join(dst, "priority_groups.sql")
-	err = ioutil.WriteFile(file, []byte(sql), 0644)
+	err = writeObjectsFile(file, "priority_groups", priorityGroupStart, entries, crit)
 	if err != nil {
 		return fmt.Errorf("Unable to backup priority groups: %s", err)
 	}
@@ -45,14 +45,20 @@ func BackupPriorityGroups(src *exasol.Conn, dst string) error {
 	return nil
 }
 
-func getPriorityGroupsToBackup(conn *exasol.Conn) ([]*priorityGroup, error) {
-	sql := `
-		SELECT priority_group_name,
+// The first line of each priority group's entry in priority_groups.sql
+var priorityGroupStart = regexp.MustCompile(`^(?:DROP|ALTER) PRIORITY GROUP \[([^\]]+)\]`)
+
+func getPriorityGroupsToBackup(conn *exasol.Conn, crit Criteria) ([]*priorityGroup, error) {
+	sql := fmt.Sprintf(`
+		SELECT priority_group_name AS s,
+			   priority_group_name AS o,
 			   priority_group_weight,
 			   priority_group_comment
 		FROM exa_priority_groups
-		ORDER BY priority_group_name
-	`
+		WHERE %s
+		ORDER BY local.s
+		`, crit.getSQLCriteria(),
+	)
 	res, err := conn.FetchSlice(sql)
 	if err != nil {
 		return nil, fmt.Errorf("Unable to get priority groups to backup: %s", err)
@@ -61,10 +67,10 @@ func getPriorityGroupsToBackup(conn *exasol.Conn) ([]*priorityGroup, error) {
 	for _, row := range res {
 		p := &priorityGroup{
 			name:   row[0].(string),
-			weight: int(row[1].(float64)),
+			weight: int(row[2].(float64)),
 		}
-		if row[2] != nil {
-			p.comment = row[2].(string)
+		if row[3] != nil {
+			p.comment = row[3].(string)
 		}
 		priorityGroups = append(priorityGroups, p)
 	}
@@ -2,18 +2,17 @@ package backup
 
 import (
 	"fmt"
-	"os"
 	"path/filepath"
 	"strings"
 
 	"github.com/GrantStreetGroup/go-exasol-client"
 )
 
-func BackupPrivileges(src *exasol.Conn, dst string, grantees []string) error {
+func BackupPrivileges(src *exasol.Conn, dst string, grantees []string, run *backupRun) error {
 	for i := range grantees {
 		grantees[i] = "'" + grantees[i] + "'"
 	}
-	privs := []func(*exasol.Conn, string, []string) error{
+	privs := []func(*exasol.Conn, string, []string, *backupRun) error{
 		backupConnectionPrivs,
 		backupRestrictedObjectPrivs,
 		backupObjectPrivs,
@@ -23,7 +22,7 @@ func BackupPrivileges(src *exasol.Conn, dst string, grantees []string) error {
 		backupSchemaOwners,
 	}
 	for _, backupPriv := range privs {
-		err := backupPriv(src, dst, grantees)
+		err := backupPriv(src, dst, grantees, run)
 		if err != nil {
 			return err
 		}
@@ -33,7 +32,7 @@ func BackupPrivileges(src *exasol.Conn, dst string, grantees []string) error {
 	return nil
 }
 
-func backupConnectionPrivs(src *exasol.Conn, dst string, grantees []string) error {
+func backupConnectionPrivs(src *exasol.Conn, dst string, grantees []string, run *backupRun) error {
 	log.Info("Backing up connection privileges")
 
 	sql := fmt.Sprintf(`
@@ -56,7 +55,7 @@ func backupConnectionPrivs(src *exasol.Conn, dst string, grantees []string) erro
 			sql += " WITH ADMIN OPTION"
 		}
 		sql += ";\n"
-		err = appendToObjFile(dst, grantee, sql)
+		err = appendToObjFile(dst, grantee, sql, run)
 		if err != nil {
 			return err
 		}
@@ -64,7 +63,7 @@ func backupConnectionPrivs(src *exasol.Conn, dst string, grantees []string) erro
 	return nil
 }
 
-func backupObjectPrivs(src *exasol.Conn, dst string, grantees []string) error {
+func backupObjectPrivs(src *exasol.Conn, dst string, grantees []string, run *backupRun) error {
 	log.Info("Backing up object privileges")
 
 	sql := fmt.Sprintf(`
@@ -92,7 +91,7 @@ func backupObjectPrivs(src *exasol.Conn, dst string, grantees []string) error {
 		}
 
 		sql := fmt.Sprintf("GRANT %s ON %s [%s] TO [%s];\n", privilege, objType, object, grantee)
-		err = appendToObjFile(dst, grantee, sql)
+		err = appendToObjFile(dst, grantee, sql, run)
 		if err != nil {
 			return err
 		}
@@ -100,7 +99,7 @@ func backupObjectPrivs(src *exasol.Conn, dst string, grantees []string) error {
 	return nil
 }
 
-func backupRestrictedObjectPrivs(src *exasol.Conn, dst string, grantees []string) error {
+func backupRestrictedObjectPrivs(src *exasol.Conn, dst string, grantees []string, run *backupRun) error {
 	log.Info("Backing up restricted object privileges")
 
 	sql := fmt.Sprintf(`
@@ -139,7 +138,7 @@ func backupRestrictedObjectPrivs(src *exasol.Conn, dst string, grantees []string
 			`GRANT %s ON %s [%s] FOR %s [%s] TO [%s];`+"\n",
 			privilege, objType, object, forObjType, forObject, grantee,
 		)
-		err = appendToObjFile(dst, grantee, sql)
+		err = appendToObjFile(dst, grantee, sql, run)
 		if err != nil {
 			return err
 		}
@@ -147,7 +146,7 @@ func backupRestrictedObjectPrivs(src *exasol.Conn, dst string, grantees []string
 	return nil
 }
 
-func backupRolePrivs(src *exasol.Conn, dst string, grantees []string) error {
+func backupRolePrivs(src *exasol.Conn, dst string, grantees []string, run *backupRun) error {
 	log.Info("Backing up role privileges")
 
 	sql := fmt.Sprintf(`
@@ -171,7 +170,7 @@ func backupRolePrivs(src *exasol.Conn, dst string, grantees []string) error {
 			sql += " WITH ADMIN OPTION"
 		}
 		sql += ";\n"
-		err = appendToObjFile(dst, grantee, sql)
+		err = appendToObjFile(dst, grantee, sql, run)
 		if err != nil {
 			return err
 		}
@@ -179,7 +178,7 @@ func backupRolePrivs(src *exasol.Conn, dst string, grantees []string) error {
 	return nil
 }
 
-func backupSystemPrivs(src *exasol.Conn, dst string, grantees []string) error {
+func backupSystemPrivs(src *exasol.Conn, dst string, grantees []string, run *backupRun) error {
 	log.Info("Backing up system privileges")
 
 	sql := fmt.Sprintf(`
@@ -203,7 +202,7 @@ func backupSystemPrivs(src *exasol.Conn, dst string, grantees []string) error {
 			sql += " WITH ADMIN OPTION"
 		}
 		sql += ";\n"
-		err = appendToObjFile(dst, grantee, sql)
+		err = appendToObjFile(dst, grantee, sql, run)
 		if err != nil {
 			return err
 		}
@@ -211,7 +210,7 @@ func backupSystemPrivs(src *exasol.Conn, dst string, grantees []string) error {
 	return nil
 }
 
-func backupImpersonationPrivs(src *exasol.Conn, dst string, grantees []string) error {
+func backupImpersonationPrivs(src *exasol.Conn, dst string, grantees []string, run *backupRun) error {
 	log.Info("Backing up impersonation privileges")
 
 	sql := fmt.Sprintf(`
@@ -230,7 +229,7 @@ func backupImpersonationPrivs(src *exasol.Conn, dst string, grantees []string) e
 		impersonationOn := row[1].(string)
 
 		sql := fmt.Sprintf("GRANT IMPERSONATION ON [%s] TO [%s];\n", impersonationOn, grantee)
-		err = appendToObjFile(dst, grantee, sql)
+		err = appendToObjFile(dst, grantee, sql, run)
 		if err != nil {
 			return err
 		}
@@ -238,7 +237,7 @@ func backupImpersonationPrivs(src *exasol.Conn, dst string, grantees []string) e
 	return nil
 }
 
-func backupSchemaOwners(src *exasol.Conn, dst string, grantees []string) error {
+func backupSchemaOwners(src *exasol.Conn, dst string, grantees []string, run *backupRun) error {
 	log.Info("Backing up schema owners")
 
 	sql := fmt.Sprintf(`
@@ -265,7 +264,7 @@ func backupSchemaOwners(src *exasol.Conn, dst string, grantees []string) error {
 		}
 
 		sql := fmt.Sprintf("ALTER %sSCHEMA [%s] CHANGE OWNER [%s];\n", virtual, schema, owner)
-		err = appendToObjFile(dst, owner, sql)
+		err = appendToObjFile(dst, owner, sql, run)
 		if err != nil {
 			return err
 		}
@@ -273,16 +272,11 @@ func backupSchemaOwners(src *exasol.Conn, dst string, grantees []string) error {
 	return nil
 }
 
-func appendToObjFile(dst, user, sql string) error {
+func appendToObjFile(dst, user, sql string, run *backupRun) error {
 	fp := filepath.Join(dst, user+".sql")
-	f, err := os.OpenFile(fp, os.O_APPEND|os.O_WRONLY, 0644)
-	if err != nil {
-		return fmt.Errorf("Unable to open file '%s': %s", fp, err)
-	}
-	_, err = f.Write([]byte(sql))
+	err := run.appendFile(fp, []byte(sql))
 	if err != nil {
 		return fmt.Errorf("Unable to write to file '%s': %s", fp, err)
 	}
-	f.Close()
 	return nil
 }
@@ -0,0 +1,76 @@
+package backup
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"time"
+)
+
+// Rather than removing the files of objects no longer existing in Exasol
+// they can be moved under a dated "_dropped/<timestamp>/" directory,
+// keeping their path relative to the destination, so that they can
+// still be recovered for a while.
+
+const quarantineDir = "_dropped"
+const quarantineTimeFormat = "20060102T150405"
+
+type quarantine struct {
+	dst string
+	dir string // This run's quarantine directory
+}
+
+// This run's quarantine is named after when it starts rather than the
+// manifest's start time so that it never depends on the previous backup.
+func newQuarantine(dst string) *quarantine {
+	return &quarantine{
+		dst: dst,
+		dir: filepath.Join(dst, quarantineDir, time.Now().Format(quarantineTimeFormat)),
+	}
+}
+
+// This moves the file or directory into the quarantine or, if there
+// isn't one (quarantining isn't enabled), removes it. The reason is
+// why it's dropped e.g. "no longer exists in Exasol".
+func (q *quarantine) remove(run *backupRun, fp, objType, reason string) error {
+	if q == nil {
+		return run.removePath(fp, objType, reason)
+	}
+	rel, err := filepath.Rel(q.dst, fp)
+	if err != nil {
+		return fmt.Errorf("Unable to quarantine %s: %s", fp, err)
+	}
+	target := filepath.Join(q.dir, rel)
+	run.makeDir(filepath.Dir(target))
+	// It may be dropped more than once within the same second
+	err = run.removePath(target, objType, "quarantined again")
+	if err != nil {
+		return fmt.Errorf("Unable to quarantine %s: %s", fp, err)
+	}
+	err = run.renamePath(fp, target, objType, "quarantined: "+reason)
+	if err != nil {
+		return fmt.Errorf("Unable to quarantine %s: %s", fp, err)
+	}
+	return nil
+}
+
+// This removes the quarantine directories older than the given number of days
+func (q *quarantine) expire(run *backupRun, days int) {
+	if q == nil || days <= 0 {
+		return
+	}
+	root := filepath.Join(q.dst, quarantineDir)
+	dirs, _ := ioutil.ReadDir(root)
+	cutoff := time.Now().AddDate(0, 0, -days)
+	for _, d := range dirs {
+		t, err := time.ParseInLocation(quarantineTimeFormat, d.Name(), time.Local)
+		if err != nil || !t.Before(cutoff) {
+			continue
+		}
+		log.Infof("Removing expired quarantine %s", d.Name())
+		err = run.removePath(filepath.Join(root, d.Name()), "quarantine", "expired")
+		if err != nil {
+			log.Warningf("Unable to remove expired quarantine %s: %s", d.Name(), err)
+		}
+	}
+}
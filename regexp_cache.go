@@ -0,0 +1,150 @@
+package backup
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/GrantStreetGroup/go-exasol-client"
+)
+
+// Go doesn't support negative lookahead regexps while Exasol does so
+// regexp criteria are evaluated in Exasol. Rather than a round trip per
+// object the names are evaluated in batches and the results are cached
+// for the rest of the run.
+
+// The number of names evaluated per query
+const regexpBatchSize = 500
+
+type regexpCache struct {
+	results map[string]bool // Keyed by pattern and "schema.object"
+	mux     sync.Mutex
+}
+
+func newRegexpCache() *regexpCache {
+	return &regexpCache{results: map[string]bool{}}
+}
+
+func regexpCacheKey(pattern, name string) string {
+	return pattern + "\x00" + name
+}
+
+func (c *regexpCache) get(pattern, name string) (matched, ok bool) {
+	if c == nil {
+		return false, false
+	}
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	matched, ok = c.results[regexpCacheKey(pattern, name)]
+	return
+}
+
+func (c *regexpCache) set(pattern, name string, matched bool) {
+	if c == nil {
+		return
+	}
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	c.results[regexpCacheKey(pattern, name)] = matched
+}
+
+// This evaluates the patterns against all of the "schema.object" names
+// not already cached, batchSize names per query.
+func (c *regexpCache) prefetch(conn *exasol.Conn, patterns, names []string) error {
+	if c == nil || len(patterns) == 0 {
+		return nil
+	}
+	var todo []string
+	seen := map[string]bool{}
+	for _, name := range names {
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+		for _, p := range patterns {
+			if _, ok := c.get(p, name); !ok {
+				todo = append(todo, name)
+				break
+			}
+		}
+	}
+
+	for len(todo) > 0 {
+		batch := todo
+		if len(batch) > regexpBatchSize {
+			batch = batch[:regexpBatchSize]
+		}
+		todo = todo[len(batch):]
+
+		res, err := fetchRegexpMatches(conn, patterns, batch)
+		if err != nil {
+			return err
+		}
+		for _, row := range res {
+			name := row[0].(string)
+			for i, p := range patterns {
+				c.set(p, name, row[i+1] == true)
+			}
+		}
+	}
+	return nil
+}
+
+// This returns a row for each name holding the name
+// followed by whether each of the patterns matches it.
+func fetchRegexpMatches(conn *exasol.Conn, patterns, names []string) ([][]interface{}, error) {
+	var cols, values []string
+	for _, p := range patterns {
+		cols = append(cols, "n REGEXP_LIKE "+regexpSQL(p))
+	}
+	for _, n := range names {
+		values = append(values, fmt.Sprintf("('%s')", qStr(n)))
+	}
+	sql := fmt.Sprintf(
+		"SELECT n, %s FROM VALUES %s AS t(n)",
+		strings.Join(cols, ", "), strings.Join(values, ", "),
+	)
+	res, err := conn.FetchSlice(sql)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to match regexp: %s", err)
+	}
+	return res, nil
+}
+
+// This evaluates the criteria's regexps against all of the given
+// [schema, object] names up front so that matches() needn't query
+// Exasol for each of them.
+func (c *Criteria) prefetch(names [][2]string) {
+	cache := c.state().regexpCache
+	if cache == nil {
+		return
+	}
+	var patterns []string
+	if c.regexpMatch {
+		patterns = append(patterns, c.match, c.skip)
+	}
+	for _, r := range c.rules {
+		if r.Regexp {
+			patterns = append(patterns, r.Pattern)
+		}
+	}
+	for i := len(patterns) - 1; i >= 0; i-- {
+		if patterns[i] == "" {
+			patterns = append(patterns[:i], patterns[i+1:]...)
+		}
+	}
+	if len(patterns) == 0 {
+		return
+	}
+	var fullNames []string
+	for _, n := range names {
+		fullNames = append(fullNames, n[0]+"."+n[1])
+	}
+	err := cache.prefetch(c.exaConn, patterns, fullNames)
+	if err != nil {
+		// matches() falls back to querying each object
+		log.Warning(err)
+	}
+}
@@ -2,8 +2,6 @@ package backup
 
 import (
 	"fmt"
-	"io/ioutil"
-	"os"
 	"path/filepath"
 
 	"github.com/GrantStreetGroup/go-exasol-client"
@@ -15,10 +13,11 @@ type role struct {
 	comment       string
 }
 
-func BackupRoles(src *exasol.Conn, dst string, dropExtras bool) error {
+func BackupRoles(src *exasol.Conn, dst string, crit Criteria, dropExtras bool) error {
 	log.Info("Backing up roles")
+	run := crit.state()
 
-	roles, err := getRolesToBackup(src)
+	roles, err := getRolesToBackup(src, crit)
 	if err != nil {
 		return err
 	}
@@ -29,14 +28,20 @@ func BackupRoles(src *exasol.Conn, dst string, dropExtras bool) error {
 
 	dir := filepath.Join(dst, "roles")
 	if dropExtras {
-		log.Infof("Remove extraneous backedup roles")
-		os.RemoveAll(dir)
+		var names []string
+		for _, r := range roles {
+			names = append(names, r.name)
+		}
+		err = removeExtraFiles("roles", dir, names, crit)
+		if err != nil {
+			return err
+		}
 	}
-	os.MkdirAll(dir, os.ModePerm)
+	run.makeDir(dir)
 
 	roleNames := []string{}
 	for _, role := range roles {
-		err = createRole(dir, role)
+		err = createRole(dir, role, run)
 		if err != nil {
 			return err
 		}
@@ -45,7 +50,7 @@ func BackupRoles(src *exasol.Conn, dst string, dropExtras bool) error {
 		}
 	}
 
-	err = BackupPrivileges(src, dir, roleNames)
+	err = BackupPrivileges(src, dir, roleNames, run)
 	if err != nil {
 		return err
 	}
@@ -54,7 +59,7 @@ func BackupRoles(src *exasol.Conn, dst string, dropExtras bool) error {
 	return nil
 }
 
-func getRolesToBackup(conn *exasol.Conn) ([]*role, error) {
+func getRolesToBackup(conn *exasol.Conn, crit Criteria) ([]*role, error) {
 	groupType := "role_priority"
 	if capability.consumerGroups {
 		groupType = "role_consumer_group"
@@ -65,8 +70,9 @@ func getRolesToBackup(conn *exasol.Conn) ([]*role, error) {
 			   %s,
 			   role_comment
 		FROM exa_all_roles
+		WHERE %s
 		ORDER BY local.s`,
-		groupType,
+		groupType, crit.getSQLCriteria(),
 	)
 	res, err := conn.FetchSlice(sql)
 	if err != nil {
@@ -87,7 +93,7 @@ func getRolesToBackup(conn *exasol.Conn) ([]*role, error) {
 	return roles, nil
 }
 
-func createRole(dst string, r *role) error {
+func createRole(dst string, r *role, run *backupRun) error {
 	log.Infof("Backing up role %s", r.name)
 
 	var sql string
@@ -106,7 +112,7 @@ func createRole(dst string, r *role) error {
 	}
 
 	file := filepath.Join(dst, r.name+".sql")
-	err := ioutil.WriteFile(file, []byte(sql), 0644)
+	err := run.writeFile(file, []byte(sql), "roles")
 	if err != nil {
 		return fmt.Errorf("Unable to backup role: %s", err)
 	}
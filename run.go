@@ -0,0 +1,18 @@
+package backup
+
+// This is the state of a single run of Backup() or DryRun(). Rather than
+// being held in package variables it's carried by the run's Criteria, and
+// passed to the routines which don't take any, so that concurrent backups
+// within the same process don't share any state.
+//
+// Each part is nil if it isn't used by the run e.g. dryRun is nil
+// unless it's a dry run and quarantine is nil unless QuarantineDrops.
+
+type backupRun struct {
+	manifest     *manifest
+	dropLimit    *dropLimit
+	quarantine   *quarantine
+	dryRun       *dryRun
+	regexpCache  *regexpCache
+	objectFilter *objectFilter
+}
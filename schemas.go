@@ -2,8 +2,6 @@ package backup
 
 import (
 	"fmt"
-	"io/ioutil"
-	"os"
 	"path/filepath"
 
 	"github.com/GrantStreetGroup/go-exasol-client"
@@ -22,13 +20,17 @@ func (s *schema) Name() string   { return "" }
 
 func BackupSchemas(src *exasol.Conn, dst string, crit Criteria, dropExtras bool) error {
 	log.Infof("Backing up schemas")
+	run := crit.state()
 
 	schemas, dbObjs, err := getSchemasToBackup(src, crit)
 	if err != nil {
 		return err
 	}
 	if dropExtras {
-		removeExtraObjects("schemas", dbObjs, dst, crit)
+		err = removeExtraObjects("schemas", dbObjs, dst, crit)
+		if err != nil {
+			return err
+		}
 	}
 
 	if len(schemas) == 0 {
@@ -37,9 +39,9 @@ func BackupSchemas(src *exasol.Conn, dst string, crit Criteria, dropExtras bool)
 	}
 
 	dir := filepath.Join(dst, "schemas")
-	os.MkdirAll(dir, os.ModePerm)
+	run.makeDir(dir)
 	for _, schema := range schemas {
-		err = createSchema(dir, schema)
+		err = createSchema(dir, schema, run)
 		if err != nil {
 			return err
 		}
@@ -68,6 +70,15 @@ func getSchemasToBackup(conn *exasol.Conn, crit Criteria) ([]*schema, []dbObj, e
 	if err != nil {
 		return nil, nil, fmt.Errorf("Unable to get schemas: %s", err)
 	}
+	skipped, err := getSkippedSchemas(conn)
+	if err != nil {
+		return nil, nil, err
+	}
+	filter := crit.state().objectFilter
+	err = filter.load(conn, "schemas", crit)
+	if err != nil {
+		return nil, nil, err
+	}
 	schemas := []*schema{}
 	dbObjs := []dbObj{}
 	for _, row := range res {
@@ -80,13 +91,15 @@ func getSchemasToBackup(conn *exasol.Conn, crit Criteria) ([]*schema, []dbObj, e
 		if row[3] != nil {
 			s.sizeLimit = uint64(row[3].(float64))
 		}
-		schemas = append(schemas, s)
 		dbObjs = append(dbObjs, s)
+		if !skipped[s.name] && !filter.excludes("schemas", s.name, "") {
+			schemas = append(schemas, s)
+		}
 	}
 	return schemas, dbObjs, nil
 }
 
-func createSchema(dst string, s *schema) error {
+func createSchema(dst string, s *schema, run *backupRun) error {
 	log.Infof("Backing up schema %s", s.name)
 	sql := fmt.Sprintf("CREATE SCHEMA IF NOT EXISTS [%s];\n", s.name)
 
@@ -98,10 +111,10 @@ func createSchema(dst string, s *schema) error {
 	}
 
 	dir := filepath.Join(dst, s.name)
-	os.MkdirAll(dir, os.ModePerm)
+	run.makeDir(dir)
 
 	file := filepath.Join(dir, "schema.sql")
-	err := ioutil.WriteFile(file, []byte(sql), 0644)
+	err := run.writeFile(file, []byte(sql), "schemas")
 	if err != nil {
 		return fmt.Errorf("Unable to backup schema: %s", err)
 	}
@@ -2,8 +2,6 @@ package backup
 
 import (
 	"fmt"
-	"io/ioutil"
-	"os"
 	"path/filepath"
 	"regexp"
 
@@ -22,13 +20,17 @@ func (s *script) Name() string   { return s.name }
 
 func BackupScripts(src *exasol.Conn, dst string, crit Criteria, dropExtras bool) error {
 	log.Info("Backing up scripts")
+	run := crit.state()
 
 	scripts, dbObjs, err := getScriptsToBackup(src, crit)
 	if err != nil {
 		return err
 	}
 	if dropExtras {
-		removeExtraObjects("scripts", dbObjs, dst, crit)
+		err = removeExtraObjects("scripts", dbObjs, dst, crit)
+		if err != nil {
+			return err
+		}
 	}
 	if len(scripts) == 0 {
 		log.Warning("Object criteria did not match any scripts")
@@ -37,8 +39,8 @@ func BackupScripts(src *exasol.Conn, dst string, crit Criteria, dropExtras bool)
 
 	for _, s := range scripts {
 		dir := filepath.Join(dst, "schemas", s.schema, "scripts")
-		os.MkdirAll(dir, os.ModePerm)
-		err = backupScript(dir, s)
+		run.makeDir(dir)
+		err = backupScript(dir, s, run)
 		if err != nil {
 			return err
 		}
@@ -63,6 +65,15 @@ func getScriptsToBackup(conn *exasol.Conn, crit Criteria) ([]*script, []dbObj, e
 	if err != nil {
 		return nil, nil, fmt.Errorf("Unable to get scripts: %s", err)
 	}
+	skipped, err := getSkippedSchemas(conn)
+	if err != nil {
+		return nil, nil, err
+	}
+	filter := crit.state().objectFilter
+	err = filter.load(conn, "scripts", crit)
+	if err != nil {
+		return nil, nil, err
+	}
 	scripts := []*script{}
 	dbObjs := []dbObj{}
 	for _, row := range res {
@@ -74,13 +85,19 @@ func getScriptsToBackup(conn *exasol.Conn, crit Criteria) ([]*script, []dbObj, e
 		if row[3] != nil {
 			s.comment = row[3].(string)
 		}
-		scripts = append(scripts, s)
 		dbObjs = append(dbObjs, s)
+		if hasAnnotation(s.comment, skipAnnotation) {
+			log.Infof("Skipping script %s.%s as it's annotated with %s", s.schema, s.name, skipAnnotation)
+			continue
+		}
+		if !skipped[s.schema] && !filter.excludes("scripts", s.schema, s.name) {
+			scripts = append(scripts, s)
+		}
 	}
 	return scripts, dbObjs, nil
 }
 
-func backupScript(dst string, s *script) error {
+func backupScript(dst string, s *script, run *backupRun) error {
 	log.Infof("Backing up script %s.%s", s.schema, s.name)
 	sText := regexp.MustCompile(`^CREATE `).
 		ReplaceAllString(s.text, "CREATE OR REPLACE ")
@@ -93,7 +110,7 @@ func backupScript(dst string, s *script) error {
 	}
 
 	file := filepath.Join(dst, s.name+".sql")
-	err := ioutil.WriteFile(file, []byte(sql), 0644)
+	err := run.writeFile(file, []byte(sql), "scripts")
 	if err != nil {
 		return fmt.Errorf("Unable to backup script: %s", err)
 	}
@@ -0,0 +1,75 @@
+package backup
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/GrantStreetGroup/go-exasol-client"
+)
+
+// This captures the state of the session Backup is handed so that
+// the changes it makes to it can be undone once it's done.
+
+type sessionState struct {
+	autocommit bool
+	params     map[string]string
+}
+
+// This saves the autocommit mode and the values of the given session parameters
+func saveSession(conn *exasol.Conn, params ...string) (*sessionState, error) {
+	attr, err := conn.GetSessionAttr()
+	if err != nil {
+		return nil, fmt.Errorf("Unable to get session attributes: %s", err)
+	}
+	s := &sessionState{
+		autocommit: attr.Autocommit,
+		params:     map[string]string{},
+	}
+	if len(params) == 0 {
+		return s, nil
+	}
+
+	sql := fmt.Sprintf(`
+		SELECT parameter_name, session_value
+		FROM exa_parameters
+		WHERE parameter_name IN ('%s')
+		`, strings.Join(params, "','"),
+	)
+	res, err := conn.FetchSlice(sql)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to get session parameters: %s", err)
+	}
+	for _, row := range res {
+		if row[1] != nil {
+			s.params[row[0].(string)] = row[1].(string)
+		}
+	}
+	return s, nil
+}
+
+// This puts the session back the way it was found. If autocommit was
+// enabled then the read transaction opened by the backup is ended too.
+// Otherwise any transaction the caller has open is left untouched.
+func (s *sessionState) restore(conn *exasol.Conn) error {
+	var errs []string
+	for name, value := range s.params {
+		_, err := conn.Execute(fmt.Sprintf("ALTER SESSION SET %s='%s'", name, qStr(value)))
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %s", name, err))
+		}
+	}
+	if s.autocommit {
+		err := conn.Rollback()
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("rollback: %s", err))
+		}
+		err = conn.EnableAutoCommit()
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("autocommit: %s", err))
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("Unable to restore session: %s", strings.Join(errs, ", "))
+	}
+	return nil
+}
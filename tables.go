@@ -1,11 +1,15 @@
 package backup
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"io/ioutil"
+	"math"
 	"os"
 	"path/filepath"
 	"regexp"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -14,20 +18,32 @@ import (
 )
 
 type table struct {
-	schema       string
-	name         string
-	rowCount     float64
-	columns      []*column
-	constraints  []*constraint
-	distribution []string
-	partition    []string
-	data         chan []byte
-	comment      string
+	schema        string
+	name          string
+	rowCount      float64
+	rawSize       float64
+	memSize       float64
+	columns       []*column
+	constraints   []*constraint
+	distribution  []string
+	partition     []string
+	data          chan []byte
+	format        CSVFormat
+	filter        string
+	masked        map[string]string
+	sampleRows    int // > 0 if only a sample of the rows is backed up
+	lastCommit    string
+	fingerprint   string
+	unchanged     bool // The data is unchanged since the last backup
+	comment       string
+	identities    map[string]string // Next identity value of each identity column
+	dataAnnotated bool              // The comment opts the data into being backed up
 }
 
 type column struct {
 	name       string
 	colType    string
+	scale      int // The fractional second digits of a TIMESTAMP
 	colDefault string
 	identity   string
 	comment    string
@@ -46,15 +62,15 @@ type constraint struct {
 func (t *table) Schema() string { return t.schema }
 func (t *table) Name() string   { return t.name }
 
-func BackupTables(src *exasol.Conn, dst string, crit Criteria, maxRows int, dropExtras bool) error {
+func BackupTables(src *exasol.Conn, dst string, crit Criteria, data DataConf, ddl DDLMode, dropExtras bool) error {
 	log.Info("Backing up tables")
 	wg := &sync.WaitGroup{}
 	wg.Add(2)
 
 	tables := make(chan *table, 10)
 	errors := make(chan error, 2)
-	go readTables(src, tables, crit, maxRows, dst, dropExtras, errors, wg)
-	go writeTables(dst, tables, crit, maxRows, errors, wg)
+	go readTables(src, tables, crit, data, dst, dropExtras, errors, wg)
+	go writeTables(dst, tables, crit, data, ddl, dropExtras, errors, wg)
 
 	wg.Wait()
 	log.Info("Done backing up tables")
@@ -66,11 +82,12 @@ func BackupTables(src *exasol.Conn, dst string, crit Criteria, maxRows int, drop
 	}
 }
 
-func readTables(conn *exasol.Conn, out chan<- *table, crit Criteria, maxRows int, dst string, dropExtras bool, errors chan<- error, wg *sync.WaitGroup) {
+func readTables(conn *exasol.Conn, out chan<- *table, crit Criteria, data DataConf, dst string, dropExtras bool, errors chan<- error, wg *sync.WaitGroup) {
 	defer func() {
 		close(out)
 		wg.Done()
 	}()
+	run := crit.state()
 
 	tables, dbObjs, err := getTablesToBackup(conn, crit)
 	if err != nil {
@@ -78,41 +95,98 @@ func readTables(conn *exasol.Conn, out chan<- *table, crit Criteria, maxRows int
 		return
 	}
 	if dropExtras {
-		removeExtraObjects("tables", dbObjs, dst, crit)
+		err = removeExtraObjects("tables", dbObjs, dst, crit)
+		if err != nil {
+			errors <- err
+			return
+		}
+	}
+	selected := map[string]bool{}
+	for _, t := range tables {
+		selected[t.schema+"."+t.name] = true
 	}
+	run.manifest.resetData("tables", crit, dbObjs, selected)
 	if len(tables) == 0 {
 		log.Warning("Object criteria did not match any tables")
 		return
 	}
 
-	err = addTableColumns(conn, tables, crit)
+	err = addTableColumns(conn, tables, dbObjs, crit)
 	if err != nil {
 		errors <- err
 		return
 	}
-	err = addTableConstraints(conn, tables, crit)
+	err = addTableConstraints(conn, tables, dbObjs, crit)
 	if err != nil {
 		errors <- err
 		return
 	}
 
+	// All tables are planned up front because samples
+	// depend on the samples taken of their parent tables.
+	sessionRecorded := data.enabled() // See Backup()
 	for _, table := range tables {
-		err = readTable(conn, table, out, maxRows)
+		err = planTableData(conn, table, data)
 		if err != nil {
 			errors <- err
 			return
 		}
+		if table.dataAnnotated && !sessionRecorded {
+			err = run.manifest.recordSession(conn)
+			if err != nil {
+				errors <- err
+				return
+			}
+			sessionRecorded = true
+		}
+	}
+	for _, table := range tables {
+		err = readTable(conn, table, tables, out, data, run)
+		if err != nil {
+			errors <- err
+			return
+		}
+	}
+}
+
+// This determines how much of the table's data, if any, will be backed up
+func planTableData(conn *exasol.Conn, t *table, data DataConf) error {
+	if t.rowCount > 0 && (data.enabled() || t.dataAnnotated) {
+		t.filter = data.rowFilter(t.schema, t.name)
+		if t.filter != "" {
+			sql := fmt.Sprintf(
+				"SELECT COUNT(*) FROM [%s].[%s] WHERE %s",
+				t.schema, t.name, t.filter,
+			)
+			res, err := conn.FetchSlice(sql)
+			if err != nil {
+				return fmt.Errorf("Unable to count filtered rows of %s.%s: %s", t.schema, t.name, err)
+			}
+			// Estimate the size of the filtered data
+			filteredCount := res[0][0].(float64)
+			t.rawSize = t.rawSize * filteredCount / t.rowCount
+			t.memSize = t.memSize * filteredCount / t.rowCount
+			t.rowCount = filteredCount
+		}
+	}
+	if !data.withinLimits(t) && t.rowCount > 0 && data.limited() {
+		t.sampleRows = data.sampleSize(t.rowCount)
 	}
+	return nil
 }
 
-func readTable(conn *exasol.Conn, t *table, out chan<- *table, maxRows int) error {
+func readTable(conn *exasol.Conn, t *table, tables []*table, out chan<- *table, data DataConf, run *backupRun) error {
 	log.Infof("Backing up %s.%s", t.schema, t.name)
-	if t.rowCount == 0 || t.rowCount > float64(maxRows) {
+	if !data.withinLimits(t) && t.sampleRows == 0 {
 		out <- t
 		return nil
 	}
-	t.data = make(chan []byte, 10000)
-	out <- t
+	selectList, masked, err := data.selectList(t.schema, t.name, t.columns)
+	if err != nil {
+		return err
+	}
+	t.masked = masked
+	t.format = data.csvFormat(t.schema, t.name)
 
 	var orderBys []string
 	for _, cnst := range t.constraints {
@@ -125,11 +199,47 @@ func readTable(conn *exasol.Conn, t *table, out chan<- *table, maxRows int) erro
 			orderBys = append(orderBys, col.name)
 		}
 	}
+	from := fmt.Sprintf("[%s].[%s]", t.schema, t.name)
+	if t.sampleRows > 0 {
+		log.Infof("Sampling %d of %0.f rows", t.sampleRows, t.rowCount)
+		from = fmt.Sprintf("(%s)", sampleSQL(t, tables, map[*table]bool{}))
+	} else if t.filter != "" {
+		from += " WHERE " + t.filter
+	}
 	exportSQL := fmt.Sprintf(
-		"EXPORT (SELECT * FROM [%s].[%s] ORDER BY [%s]) INTO CSV AT '%%s' FILE 'data.csv'",
-		t.schema, t.name, strings.Join(orderBys, `],[`),
+		"EXPORT (SELECT %s FROM %s ORDER BY [%s]) INTO CSV AT '%%s' FILE 'data.csv'%s",
+		selectList, strings.ReplaceAll(from, "%", "%%"),
+		qExportIdent(strings.Join(orderBys, `],[`)), t.format.exportOptions(),
 	)
 
+	if data.SkipUnchanged && !data.alwaysReexport(t) {
+		t.fingerprint = dataFingerprint(t, tables, exportSQL)
+		prev := run.manifest.previousData("tables", t.schema, t.name)
+		if t.fingerprint != "" && prev != nil && prev.Fingerprint == t.fingerprint {
+			_, err := os.Stat(filepath.Join(run.manifest.dst, prev.File))
+			if err == nil {
+				log.Infof("Skipping unchanged data for %s.%s", t.schema, t.name)
+				t.unchanged = true
+				t.identities = prev.Identities
+				out <- t
+				return nil
+			}
+		}
+	}
+
+	err = addIdentityValues(conn, t)
+	if err != nil {
+		return err
+	}
+
+	t.data = make(chan []byte, 10000)
+	// However we return writeTables mustn't be left waiting for the data
+	defer close(t.data)
+	out <- t
+	if run.dryRun != nil {
+		return nil // Nothing is exported
+	}
+
 	start := time.Now()
 	res := conn.StreamQuery(exportSQL)
 	if res.Error != nil {
@@ -138,7 +248,6 @@ func readTable(conn *exasol.Conn, t *table, out chan<- *table, maxRows int) erro
 	for d := range res.Data {
 		t.data <- d
 	}
-	close(t.data)
 	duration := time.Since(start).Seconds()
 
 	totalMB := float64(res.BytesRead) / 1048576
@@ -148,6 +257,217 @@ func readTable(conn *exasol.Conn, t *table, out chan<- *table, maxRows int) erro
 	return nil
 }
 
+// This determines the value each identity column needs to be set to once
+// the backed up data is loaded. It's the greater of the column's current
+// identity value and the value after its largest one in the table.
+func addIdentityValues(conn *exasol.Conn, t *table) error {
+	var cols, exprs []string
+	for _, c := range t.columns {
+		if c.identity != "" {
+			cols = append(cols, c.name)
+			exprs = append(exprs, fmt.Sprintf(
+				"CAST(GREATEST(COALESCE(MAX([%s]) + 1, 0), %s) AS VARCHAR(40))",
+				c.name, c.identity,
+			))
+		}
+	}
+	if len(cols) == 0 {
+		return nil
+	}
+	sql := fmt.Sprintf(
+		"SELECT %s FROM [%s].[%s]",
+		strings.Join(exprs, ", "), t.schema, t.name,
+	)
+	res, err := conn.FetchSlice(sql)
+	if err != nil {
+		return fmt.Errorf("Unable to get identity values of %s.%s: %s", t.schema, t.name, err)
+	}
+	t.identities = map[string]string{}
+	for i, col := range cols {
+		t.identities[col] = res[0][i].(string)
+	}
+	return nil
+}
+
+// This returns a fingerprint of the table's data as it is to be exported.
+// It's based on the last commit to the table (and to any tables its sample
+// depends on), its row count (after any row filter), and the export
+// statement itself so that any change to the data or to how it's exported
+// changes the fingerprint. If no fingerprint can be determined "" is returned.
+func dataFingerprint(t *table, tables []*table, exportSQL string) string {
+	if t.lastCommit == "" {
+		return ""
+	}
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\n%0.f\n%s\n", t.lastCommit, t.rowCount, exportSQL)
+	if t.sampleRows > 0 {
+		for _, dep := range tables {
+			if dep != t && strings.Contains(exportSQL, fmt.Sprintf("[%s].[%s]", dep.schema, dep.name)) {
+				if dep.lastCommit == "" {
+					return ""
+				}
+				fmt.Fprintf(h, "%s.%s %s\n", dep.schema, dep.name, dep.lastCommit)
+			}
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// This returns a query selecting a deterministic sample of the table's rows.
+// Rows are picked in order of the hash of their primary key (or of all of
+// their columns) and any foreign keys referencing other sampled tables
+// are restricted to the rows picked from those tables.
+func sampleSQL(t *table, tables []*table, visited map[*table]bool) string {
+	visited[t] = true
+	defer delete(visited, t)
+	alias := fmt.Sprintf("s%d", len(visited))
+
+	var hashCols []string
+	for _, cnst := range t.constraints {
+		if cnst.conType == "PRIMARY KEY" {
+			for _, c := range cnst.columns {
+				hashCols = append(hashCols, fmt.Sprintf("%s.[%s]", alias, c))
+			}
+		}
+	}
+	if len(hashCols) == 0 {
+		for _, c := range t.columns {
+			hashCols = append(hashCols, fmt.Sprintf("%s.[%s]", alias, c.name))
+		}
+	}
+
+	var where []string
+	if t.filter != "" {
+		where = append(where, "("+t.filter+")")
+	}
+	for _, cnst := range t.constraints {
+		if cnst.conType != "FOREIGN KEY" {
+			continue
+		}
+		var parent *table
+		for _, p := range tables {
+			if p.schema == cnst.refSchema && p.name == cnst.refTable {
+				parent = p
+				break
+			}
+		}
+		if parent == nil || parent.sampleRows == 0 || visited[parent] {
+			continue
+		}
+		var nulls, joins []string
+		for i, c := range cnst.columns {
+			nulls = append(nulls, fmt.Sprintf("%s.[%s] IS NULL", alias, c))
+			joins = append(joins, fmt.Sprintf(
+				"p.[%s] = %s.[%s]", cnst.refColumns[i], alias, c,
+			))
+		}
+		where = append(where, fmt.Sprintf(
+			"(%s OR EXISTS (SELECT 1 FROM (%s) AS p WHERE %s))",
+			strings.Join(nulls, " OR "),
+			sampleSQL(parent, tables, visited),
+			strings.Join(joins, " AND "),
+		))
+	}
+
+	sql := fmt.Sprintf("SELECT %s.* FROM [%s].[%s] AS %s", alias, t.schema, t.name, alias)
+	if len(where) > 0 {
+		sql += " WHERE " + strings.Join(where, " AND ")
+	}
+	sql += fmt.Sprintf(
+		" ORDER BY HASH_MD5(%s) LIMIT %d",
+		strings.Join(hashCols, ", "), t.sampleRows,
+	)
+	return sql
+}
+
+// This returns the number of rows to sample from a table with
+// the given number of rows. It is 0 if sampling isn't enabled.
+func (d DataConf) sampleSize(rowCount float64) int {
+	size := 0
+	if d.SampleRows > 0 {
+		size = d.SampleRows
+	}
+	if d.SamplePercent > 0 {
+		pctSize := int(math.Ceil(rowCount * d.SamplePercent / 100))
+		if size == 0 || pctSize < size {
+			size = pctSize
+		}
+	}
+	if float64(size) > rowCount {
+		size = int(rowCount)
+	}
+	return size
+}
+
+// Functions whose result can change while the table doesn't
+var nonDeterministicRegexp = regexp.MustCompile(`(?i)\b(` +
+	`CURRENT_DATE|CURRENT_TIMESTAMP|LOCALTIMESTAMP|SYSDATE|SYSTIMESTAMP|NOW|` +
+	`CURRENT_SESSION|CURRENT_STATEMENT|CURRENT_USER|USER|RAND|RANDOM|` +
+	`CURRENT_SCHEMA|SYS_GUID)\b`)
+
+// This returns true if the table's data is to be re-exported even if its
+// fingerprint hasn't changed because its row filter can select different
+// rows of unchanged data.
+func (d DataConf) alwaysReexport(t *table) bool {
+	if t.filter == "" {
+		return false
+	}
+	return d.ReexportFiltered || nonDeterministicRegexp.MatchString(t.filter)
+}
+
+// This returns the SQL predicate restricting which rows
+// of the given table are backed up or "" if there is none.
+func (d DataConf) rowFilter(schema, object string) string {
+	var patterns []string
+	for p := range d.RowFilters {
+		patterns = append(patterns, p)
+	}
+	pattern := matchingPattern(patterns, schema, object)
+	if pattern == "" {
+		return ""
+	}
+	return d.RowFilters[pattern]
+}
+
+// This returns true if any data is to be backed up at all
+func (d DataConf) enabled() bool {
+	return d.limited() || d.Match != ""
+}
+
+// This returns true if any of the data limits are set
+func (d DataConf) limited() bool {
+	return d.MaxRows > 0 || d.MaxBytes > 0 || d.MaxCompressedBytes > 0
+}
+
+// This returns true if the object's data is to be
+// backed up regardless of the configured limits
+func (d DataConf) matches(schema, object string) bool {
+	return d.Match != "" && matchesCriteria(d.Match, schema, object, false, false, nil, nil)
+}
+
+// This checks whether the table's data falls within all of the configured limits
+func (d DataConf) withinLimits(t *table) bool {
+	if t.rowCount == 0 {
+		return false
+	}
+	if t.dataAnnotated || d.matches(t.schema, t.name) {
+		return true
+	}
+	if !d.limited() {
+		return false
+	}
+	if d.MaxRows > 0 && t.rowCount > float64(d.MaxRows) {
+		return false
+	}
+	if d.MaxBytes > 0 && t.rawSize > float64(d.MaxBytes) {
+		return false
+	}
+	if d.MaxCompressedBytes > 0 && t.memSize > float64(d.MaxCompressedBytes) {
+		return false
+	}
+	return true
+}
+
 func getTablesToBackup(conn *exasol.Conn, crit Criteria) ([]*table, []dbObj, error) {
 	sql := fmt.Sprintf(`
 		SELECT table_schema AS s,
@@ -155,7 +475,10 @@ func getTablesToBackup(conn *exasol.Conn, crit Criteria) ([]*table, []dbObj, err
 			   table_row_count,
 			   table_comment,
 			   distribution,
-			   partition
+			   partition,
+			   os.raw_object_size,
+			   os.mem_object_size,
+			   os.last_commit
 		FROM exa_all_tables
 		LEFT JOIN (
 			SELECT column_schema AS s,
@@ -180,6 +503,10 @@ func getTablesToBackup(conn *exasol.Conn, crit Criteria) ([]*table, []dbObj, err
 		) AS dist_part
 		  ON dist_part.s = table_schema
 		 AND dist_part.o = table_name
+		LEFT JOIN exa_all_object_sizes AS os
+		  ON os.root_name = table_schema
+		 AND os.object_name = table_name
+		 AND os.object_type = 'TABLE'
 		WHERE table_is_virtual = FALSE
 		  AND (%s)
 		ORDER BY table_schema, table_name
@@ -191,6 +518,15 @@ func getTablesToBackup(conn *exasol.Conn, crit Criteria) ([]*table, []dbObj, err
 	if err != nil {
 		return nil, nil, fmt.Errorf("Unable to get tables: %s", err)
 	}
+	skipped, err := getSkippedSchemas(conn)
+	if err != nil {
+		return nil, nil, err
+	}
+	filter := crit.state().objectFilter
+	err = filter.load(conn, "tables", crit)
+	if err != nil {
+		return nil, nil, err
+	}
 	tables := []*table{}
 	dbObjs := []dbObj{}
 	for _, row := range res {
@@ -210,19 +546,35 @@ func getTablesToBackup(conn *exasol.Conn, crit Criteria) ([]*table, []dbObj, err
 		if row[5] != nil {
 			t.partition = strings.Split(row[5].(string), ",")
 		}
-		tables = append(tables, t)
+		if row[6] != nil {
+			t.rawSize = row[6].(float64)
+		}
+		if row[7] != nil {
+			t.memSize = row[7].(float64)
+		}
+		if row[8] != nil {
+			t.lastCommit = row[8].(string)
+		}
 		dbObjs = append(dbObjs, t)
+		if hasAnnotation(t.comment, skipAnnotation) {
+			log.Infof("Skipping table %s.%s as it's annotated with %s", t.schema, t.name, skipAnnotation)
+			continue
+		}
+		if !skipped[t.schema] && !filter.excludes("tables", t.schema, t.name) {
+			t.dataAnnotated = hasAnnotation(t.comment, dataAnnotation)
+			tables = append(tables, t)
+		}
 	}
 	return tables, dbObjs, nil
 }
 
-func addTableColumns(conn *exasol.Conn, tables []*table, crit Criteria) error {
+func addTableColumns(conn *exasol.Conn, tables []*table, dbObjs []dbObj, crit Criteria) error {
 	sql := fmt.Sprintf(`
 		SELECT column_schema AS s,
 			   column_table  AS o,
 			   column_name,    column_type,
 			   column_default, column_identity,
-			   column_comment
+			   column_comment, column_num_scale
 		FROM exa_all_columns
 		WHERE column_object_type = 'TABLE'
 		  AND column_is_virtual = FALSE
@@ -251,16 +603,10 @@ func addTableColumns(conn *exasol.Conn, tables []*table, crit Criteria) error {
 		if row[6] != nil {
 			col.comment = row[6].(string)
 		}
-		var table *table
-		for _, t := range tables {
-			if t.schema == schemaName &&
-				t.name == tableName {
-				table = t
-				break
-			}
-		}
+		col.scale = timestampScale(row[7])
+		table := findTable(tables, dbObjs, schemaName, tableName, "columns")
 		if table == nil {
-			return fmt.Errorf("Unable to find table %s.%s for column", schemaName, tableName)
+			continue
 		}
 
 		table.columns = append(table.columns, col)
@@ -268,7 +614,7 @@ func addTableColumns(conn *exasol.Conn, tables []*table, crit Criteria) error {
 	return nil
 }
 
-func addTableConstraints(conn *exasol.Conn, tables []*table, crit Criteria) error {
+func addTableConstraints(conn *exasol.Conn, tables []*table, dbObjs []dbObj, crit Criteria) error {
 	sql := fmt.Sprintf(`
 		SELECT con.constraint_schema AS s,
 			   con.constraint_table  AS o,
@@ -327,16 +673,9 @@ func addTableConstraints(conn *exasol.Conn, tables []*table, crit Criteria) erro
 			con.refColumns = strings.Split(row[8].(string), ",")
 		}
 
-		var table *table
-		for _, t := range tables {
-			if t.schema == schemaName &&
-				t.name == tableName {
-				table = t
-				break
-			}
-		}
+		table := findTable(tables, dbObjs, schemaName, tableName, "constraints")
 		if table == nil {
-			return fmt.Errorf("Unable to find table %s.%s for constraint", schemaName, tableName)
+			continue
 		}
 
 		table.constraints = append(table.constraints, con)
@@ -344,51 +683,78 @@ func addTableConstraints(conn *exasol.Conn, tables []*table, crit Criteria) erro
 	return nil
 }
 
-func writeTables(dst string, in <-chan *table, crit Criteria, maxRows int, errors chan<- error, wg *sync.WaitGroup) {
+// This returns the table being backed up which the columns or constraints
+// (what) belong to. It's nil for tables which are skipped e.g. by an
+// annotation, and for those which weren't in the catalog when the tables
+// were read, e.g. as they've been created since, which are warned about.
+func findTable(tables []*table, dbObjs []dbObj, schema, name, what string) *table {
+	for _, t := range tables {
+		if t.schema == schema && t.name == name {
+			return t
+		}
+	}
+	for _, o := range dbObjs {
+		if o.Schema() == schema && o.Name() == name {
+			return nil // It's skipped
+		}
+	}
+	log.Warningf("Ignoring the %s of %s.%s as the table wasn't found", what, schema, name)
+	return nil
+}
+
+func writeTables(dst string, in <-chan *table, crit Criteria, data DataConf, ddl DDLMode, dropExtras bool, errors chan<- error, wg *sync.WaitGroup) {
+	defer wg.Done()
+	run := crit.state()
+	schemaTables := map[string][]*table{}
 	for t := range in {
+		schemaTables[t.schema] = append(schemaTables[t.schema], t)
 		dir := filepath.Join(dst, "schemas", t.schema, "tables")
-		os.MkdirAll(dir, os.ModePerm)
-		err := createTable(dir, t)
-		if err != nil {
-			errors <- err
-			return
+		run.makeDir(dir)
+		err := createTable(dir, t, ddl, run)
+		if err == nil {
+			err = writeTableData(dir, t, data, dropExtras, run)
 		}
-		err = writeTableData(dir, t, maxRows)
 		if err != nil {
 			errors <- err
+			// Otherwise readTables would block sending the rest
+			discardTables(t, in)
 			return
 		}
 		t.data = nil // otherwise seems to leak mem
 	}
 
-	wg.Done()
+	err := writeForeignKeys(dst, schemaTables, crit, ddl, dropExtras)
+	if err == nil {
+		err = writeIdentities(dst, schemaTables, crit, dropExtras)
+	}
+	if err != nil {
+		errors <- err
+	}
 }
 
-func createTable(dir string, t *table) error {
+// This discards the given table's remaining data and the rest of the tables
+func discardTables(t *table, in <-chan *table) {
+	for {
+		if t.data != nil {
+			for range t.data {
+			}
+		}
+		var ok bool
+		t, ok = <-in
+		if !ok {
+			return
+		}
+	}
+}
+
+func createTable(dir string, t *table, ddl DDLMode, run *backupRun) error {
 	sysConstraint := regexp.MustCompile(`SYS_\d+`)
+	if ddl == CREATE_IF_NOT_EXISTS {
+		return createTableIfNotExists(dir, t, sysConstraint, run)
+	}
 	var cols []string
 	for _, c := range t.columns {
-		col := fmt.Sprintf(`"%s" %s`, c.name, c.colType)
-		if c.colDefault != "" {
-			col += fmt.Sprintf(" DEFAULT %s", c.colDefault)
-		}
-		if c.identity != "" {
-			col += fmt.Sprintf(" IDENTITY %s", c.identity)
-		}
-		// in-line constraints
-		for _, cnst := range t.constraints {
-			if cnst.conType == "NOT NULL" &&
-				cnst.columns[0] == c.name {
-				if cnst.name != "" && !sysConstraint.MatchString(cnst.name) {
-					col += fmt.Sprintf(` CONSTRAINT "%s"`, cnst.name)
-				}
-				col += " NOT NULL"
-				if !cnst.enabled {
-					col += " DISABLE"
-				}
-				break
-			}
-		}
+		col := columnDefinition(t, c, sysConstraint)
 		if c.comment != "" {
 			col += fmt.Sprintf(" COMMENT IS '%s'", qStr(c.comment))
 		}
@@ -396,8 +762,9 @@ func createTable(dir string, t *table) error {
 	}
 
 	// out-of-line constraints
+	// (foreign keys are added once all tables are created and loaded)
 	for _, cnst := range t.constraints {
-		if cnst.conType == "NOT NULL" {
+		if cnst.conType == "NOT NULL" || cnst.conType == "FOREIGN KEY" {
 			continue
 		}
 		col := ""
@@ -408,13 +775,6 @@ func createTable(dir string, t *table) error {
 			`%s ("%s")`,
 			cnst.conType, strings.Join(cnst.columns, `","`),
 		)
-		if cnst.conType == "FOREIGN KEY" {
-			col += fmt.Sprintf(
-				` REFERENCES "%s"."%s" ("%s")`,
-				cnst.refSchema, cnst.refTable,
-				strings.Join(cnst.refColumns, `","`),
-			)
-		}
 		if !cnst.enabled {
 			col += " DISABLE"
 		}
@@ -440,30 +800,292 @@ func createTable(dir string, t *table) error {
 		sql += fmt.Sprintf(" COMMENT IS '%s'", qStr(t.comment))
 	}
 	sql += ";\n"
-	file := filepath.Join(dir, t.name+".sql")
+	return writeTableDDL(dir, t, sql, run)
+}
+
+// This creates the table only if it doesn't already exist and then brings
+// the distribution, partitioning and comments of an existing table in line
+// using idempotent statements. Unlike CREATE OR REPLACE this never drops
+// any data. Primary keys and other out-of-line constraints are part of the
+// CREATE so that those of an existing table, which foreign keys may
+// reference, are left alone. They're always named, even if their name was
+// generated by the system, so that they match on subsequent restores.
+func createTableIfNotExists(dir string, t *table, sysConstraint *regexp.Regexp, run *backupRun) error {
+	var cols []string
+	for _, c := range t.columns {
+		cols = append(cols, columnDefinition(t, c, sysConstraint))
+	}
+	tbl := fmt.Sprintf(`"%s"."%s"`, t.schema, t.name)
+	// Named constraints are (re)added to existing tables too. Unnamed ones
+	// can't be dropped first so they're only created along with the table.
+	var cnstStmts []string
+	for _, cnst := range t.constraints {
+		if cnst.conType == "NOT NULL" || cnst.conType == "FOREIGN KEY" {
+			continue
+		}
+		def := fmt.Sprintf(
+			`%s ("%s")`,
+			cnst.conType, strings.Join(cnst.columns, `","`),
+		)
+		if !cnst.enabled {
+			def += " DISABLE"
+		}
+		if cnst.name == "" {
+			cols = append(cols, def)
+			continue
+		}
+		cnstStmts = append(cnstStmts, fmt.Sprintf(
+			"ALTER TABLE %s DROP CONSTRAINT IF EXISTS \"%s\";\n"+
+				"ALTER TABLE %s ADD CONSTRAINT \"%s\" %s;\n",
+			tbl, cnst.name, tbl, cnst.name, def,
+		))
+	}
+	sql := fmt.Sprintf(
+		"CREATE TABLE IF NOT EXISTS %s (\n\t%s\n);\n",
+		tbl, strings.Join(cols, ",\n\t"),
+	)
+	sql += strings.Join(cnstStmts, "")
+
+	if len(t.distribution) > 0 {
+		sql += fmt.Sprintf(
+			"ALTER TABLE %s DISTRIBUTE BY \"%s\";\n",
+			tbl, strings.Join(t.distribution, `","`),
+		)
+	}
+	if len(t.partition) > 0 {
+		sql += fmt.Sprintf(
+			"ALTER TABLE %s PARTITION BY \"%s\";\n",
+			tbl, strings.Join(t.partition, `","`),
+		)
+	}
+	if t.comment != "" {
+		sql += fmt.Sprintf("COMMENT ON TABLE %s IS '%s';\n", tbl, qStr(t.comment))
+	}
+	for _, c := range t.columns {
+		if c.comment != "" {
+			sql += fmt.Sprintf(
+				"COMMENT ON COLUMN %s.\"%s\" IS '%s';\n",
+				tbl, c.name, qStr(c.comment),
+			)
+		}
+	}
+	return writeTableDDL(dir, t, sql, run)
+}
+
+// Foreign keys are written to a separate per-schema file as ALTER TABLE
+// statements which are to be run once all of the tables are created and
+// loaded, since the referenced tables may otherwise not exist yet.
+const foreignKeysFile = "constraints.sql"
+
+// Identity columns are moved past the values of the loaded rows by a
+// separate per-schema file which is to be run once the data is imported.
+// Otherwise new inserts may produce duplicate keys.
+const identitiesFile = "identities.sql"
+
+func writeForeignKeys(dst string, schemaTables map[string][]*table, crit Criteria, ddl DDLMode, dropExtras bool) error {
+	sysConstraint := regexp.MustCompile(`SYS_\d+`)
+	return writeSchemaStmts(dst, foreignKeysFile, "foreign keys", schemaTables, crit, dropExtras, func(t *table) []string {
+		var stmts []string
+		tbl := fmt.Sprintf(`"%s"."%s"`, t.schema, t.name)
+		for _, cnst := range t.constraints {
+			if cnst.conType != "FOREIGN KEY" {
+				continue
+			}
+			stmt := ""
+			name := ""
+			if ddl == CREATE_IF_NOT_EXISTS && cnst.name != "" {
+				stmt = fmt.Sprintf("ALTER TABLE %s DROP CONSTRAINT IF EXISTS \"%s\"; ", tbl, cnst.name)
+				name = fmt.Sprintf(`CONSTRAINT "%s" `, cnst.name)
+			} else if cnst.name != "" && !sysConstraint.MatchString(cnst.name) {
+				name = fmt.Sprintf(`CONSTRAINT "%s" `, cnst.name)
+			}
+			stmt += fmt.Sprintf(
+				`ALTER TABLE %s ADD %sFOREIGN KEY ("%s") REFERENCES "%s"."%s" ("%s")`,
+				tbl, name, strings.Join(cnst.columns, `","`),
+				cnst.refSchema, cnst.refTable, strings.Join(cnst.refColumns, `","`),
+			)
+			if !cnst.enabled {
+				stmt += " DISABLE"
+			}
+			stmts = append(stmts, stmt+";")
+		}
+		return stmts
+	})
+}
+
+func writeIdentities(dst string, schemaTables map[string][]*table, crit Criteria, dropExtras bool) error {
+	return writeSchemaStmts(dst, identitiesFile, "identities", schemaTables, crit, dropExtras, func(t *table) []string {
+		var stmts []string
+		for _, c := range t.columns {
+			if next, ok := t.identities[c.name]; ok {
+				stmts = append(stmts, fmt.Sprintf(
+					`ALTER TABLE "%s"."%s" ALTER COLUMN "%s" SET IDENTITY %s;`,
+					t.schema, t.name, c.name, next,
+				))
+			}
+		}
+		return stmts
+	})
+}
+
+// This writes the given per-schema file of ALTER TABLE statements.
+// Each line holds the statement(s) for a single table object. Lines of
+// tables outside of this run's criteria are retained from the existing file.
+// A file left without any statements is dropped if dropExtras, like the files
+// of extraneous objects, and is otherwise emptied.
+func writeSchemaStmts(dst, fileName, desc string, schemaTables map[string][]*table, crit Criteria, dropExtras bool, getStmts func(*table) []string) error {
+	schemaDir := filepath.Join(dst, "schemas")
+	run := crit.state()
+
+	// Schemas with an existing file may no longer have any matching tables
+	schemas := map[string]bool{}
+	for schema := range schemaTables {
+		schemas[schema] = true
+	}
+	dirs, _ := ioutil.ReadDir(schemaDir)
+	for _, d := range dirs {
+		_, err := os.Stat(filepath.Join(schemaDir, d.Name(), fileName))
+		if err == nil && crit.matches(d.Name(), "") {
+			schemas[d.Name()] = true
+		}
+	}
+
+	for schema := range schemas {
+		fp := filepath.Join(schemaDir, schema, fileName)
+		tableStmts := map[string][]string{}
+
+		content, err := ioutil.ReadFile(fp)
+		if err == nil {
+			tblRegexp := regexp.MustCompile(`^ALTER TABLE "((?:[^"]|"")+)"\."((?:[^"]|"")+)"`)
+			lines := strings.Split(string(content), "\n")
+			var names [][2]string
+			for _, line := range lines {
+				if m := tblRegexp.FindStringSubmatch(line); m != nil {
+					names = append(names, [2]string{m[1], m[2]})
+				}
+			}
+			crit.prefetch(names)
+			for _, line := range lines {
+				m := tblRegexp.FindStringSubmatch(line)
+				if m != nil && (!crit.matches(m[1], m[2]) || run.objectFilter.excludes("tables", m[1], m[2])) {
+					tableStmts[m[2]] = append(tableStmts[m[2]], line)
+				}
+			}
+		}
+
+		for _, t := range schemaTables[schema] {
+			stmts := getStmts(t)
+			if len(stmts) > 0 {
+				tableStmts[t.name] = append(tableStmts[t.name], stmts...)
+			}
+		}
+
+		var tableNames []string
+		for name := range tableStmts {
+			tableNames = append(tableNames, name)
+		}
+		sort.Strings(tableNames)
+		var sql string
+		for _, name := range tableNames {
+			sql += strings.Join(tableStmts[name], "\n") + "\n"
+		}
 
-	err := ioutil.WriteFile(file, []byte(sql), 0644)
+		if sql == "" {
+			if _, err := os.Stat(fp); err != nil {
+				continue // There's nothing to drop
+			}
+			if dropExtras {
+				err = run.dropLimit.drop(desc)
+				if err == nil {
+					log.Infof("Dropping %s", fp)
+					err = run.quarantine.remove(run, fp, "tables", "no longer has any "+desc)
+				}
+				if err != nil {
+					return fmt.Errorf("Unable to drop %s of schema %s: %s", desc, schema, err)
+				}
+				continue
+			}
+		}
+		err = run.writeFile(fp, []byte(sql), "tables")
+		if err != nil {
+			return fmt.Errorf("Unable to backup %s of schema %s: %s", desc, schema, err)
+		}
+	}
+	return nil
+}
+
+// This returns the column's definition including its in-line constraints
+func columnDefinition(t *table, c *column, sysConstraint *regexp.Regexp) string {
+	col := fmt.Sprintf(`"%s" %s`, c.name, c.colType)
+	if c.colDefault != "" {
+		col += fmt.Sprintf(" DEFAULT %s", c.colDefault)
+	}
+	if c.identity != "" {
+		col += fmt.Sprintf(" IDENTITY %s", c.identity)
+	}
+	// in-line constraints
+	for _, cnst := range t.constraints {
+		if cnst.conType == "NOT NULL" &&
+			cnst.columns[0] == c.name {
+			if cnst.name != "" && !sysConstraint.MatchString(cnst.name) {
+				col += fmt.Sprintf(` CONSTRAINT "%s"`, cnst.name)
+			}
+			col += " NOT NULL"
+			if !cnst.enabled {
+				col += " DISABLE"
+			}
+			break
+		}
+	}
+	return col
+}
+
+func writeTableDDL(dir string, t *table, sql string, run *backupRun) error {
+	file := filepath.Join(dir, t.name+".sql")
+	err := run.writeFile(file, []byte(sql), "tables")
 	if err != nil {
 		return fmt.Errorf("Unable to backup table %s.%s: %s", t.schema, t.name, err)
 	}
 	return nil
 }
 
-func writeTableData(dir string, t *table, maxRows int) error {
-	if t.rowCount == 0 || t.rowCount > float64(maxRows) {
-		return nil
+func writeTableData(dir string, t *table, data DataConf, dropExtras bool, run *backupRun) error {
+	if t.unchanged {
+		// Leave the existing data file as it is
+		prev := run.manifest.previousData("tables", t.schema, t.name)
+		run.manifest.addData("tables", prev)
+		return retireDataFiles(dir, t.name, filepath.Base(prev.File), dropExtras, run)
+	}
+
+	fileName := t.name + ".csv"
+	if t.sampleRows > 0 {
+		fileName = t.name + ".sample.csv"
 	}
-	fp := filepath.Join(dir, t.name+".csv")
-	f, err := os.Create(fp)
+	if t.data == nil {
+		fileName = "" // The data isn't being backed up
+	}
+	// Make sure no outdated data is left next to the current DDL
+	err := retireDataFiles(dir, t.name, fileName, dropExtras, run)
 	if err != nil {
-		return fmt.Errorf("Unable to create file %s: %s", fp, err)
+		return err
 	}
-	for d := range t.data {
-		_, err = f.Write(d)
-		if err != nil {
-			return fmt.Errorf("Unable to write to file %s: %s", fp, err)
-		}
+	if t.data == nil {
+		return nil
+	}
+	err = run.writeDataFile(filepath.Join(dir, fileName), t.data, "tables")
+	if err != nil {
+		return err
 	}
-	f.Close()
+	run.manifest.addData("tables", &dataEntry{
+		Schema:      t.schema,
+		Name:        t.name,
+		File:        filepath.Join("schemas", t.schema, "tables", fileName),
+		Format:      t.format,
+		Filter:      t.filter,
+		Masked:      t.masked,
+		Sample:      t.sampleRows > 0,
+		Fingerprint: t.fingerprint,
+		Identities:  t.identities,
+	})
 	return nil
 }
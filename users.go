@@ -2,8 +2,6 @@ package backup
 
 import (
 	"fmt"
-	"io/ioutil"
-	"os"
 	"path/filepath"
 
 	"github.com/GrantStreetGroup/go-exasol-client"
@@ -20,10 +18,11 @@ type user struct {
 	passPolicy    string
 }
 
-func BackupUsers(src *exasol.Conn, dst string, dropExtras bool) error {
+func BackupUsers(src *exasol.Conn, dst string, crit Criteria, dropExtras bool) error {
 	log.Info("Backing up users")
+	run := crit.state()
 
-	users, err := getUsersToBackup(src)
+	users, err := getUsersToBackup(src, crit)
 	if err != nil {
 		return err
 	}
@@ -34,21 +33,27 @@ func BackupUsers(src *exasol.Conn, dst string, dropExtras bool) error {
 
 	dir := filepath.Join(dst, "users")
 	if dropExtras {
-		log.Infof("Removing extraneous backedup users")
-		os.RemoveAll(dir)
+		var names []string
+		for _, u := range users {
+			names = append(names, u.name)
+		}
+		err = removeExtraFiles("users", dir, names, crit)
+		if err != nil {
+			return err
+		}
 	}
-	os.MkdirAll(dir, os.ModePerm)
+	run.makeDir(dir)
 
 	var userNames []string
 	for _, user := range users {
-		err = backupUser(dir, user)
+		err = backupUser(dir, user, run)
 		if err != nil {
 			return err
 		}
 		userNames = append(userNames, user.name)
 	}
 
-	err = BackupPrivileges(src, dir, userNames)
+	err = BackupPrivileges(src, dir, userNames, run)
 	if err != nil {
 		return err
 	}
@@ -57,7 +62,7 @@ func BackupUsers(src *exasol.Conn, dst string, dropExtras bool) error {
 	return nil
 }
 
-func getUsersToBackup(conn *exasol.Conn) ([]*user, error) {
+func getUsersToBackup(conn *exasol.Conn, crit Criteria) ([]*user, error) {
 	groupType := "user_priority"
 	if capability.consumerGroups {
 		groupType = "user_consumer_group"
@@ -74,8 +79,9 @@ func getUsersToBackup(conn *exasol.Conn) ([]*user, error) {
 			   openid_subject
 		FROM exa_dba_users
 		WHERE user_name != 'SYS'
+		  AND (%s)
 		ORDER BY local.s`,
-		groupType,
+		groupType, crit.getSQLCriteria(),
 	)
 	res, err := conn.FetchSlice(sql)
 	if err != nil {
@@ -111,7 +117,7 @@ func getUsersToBackup(conn *exasol.Conn) ([]*user, error) {
 	return users, nil
 }
 
-func backupUser(dst string, u *user) error {
+func backupUser(dst string, u *user, run *backupRun) error {
 	log.Infof("Backing up user %s", u.name)
 
 	sql := ""
@@ -161,7 +167,7 @@ func backupUser(dst string, u *user) error {
 	}
 
 	file := filepath.Join(dst, u.name+".sql")
-	err := ioutil.WriteFile(file, []byte(sql), 0644)
+	err := run.writeFile(file, []byte(sql), "users")
 	if err != nil {
 		return fmt.Errorf("Unable to backup user %s: %s", u.name, err)
 	}
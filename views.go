@@ -2,8 +2,6 @@ package backup
 
 import (
 	"fmt"
-	"io/ioutil"
-	"os"
 	"path/filepath"
 	"regexp"
 	"sync"
@@ -21,16 +19,25 @@ type view struct {
 func (v *view) Schema() string { return v.schema }
 func (v *view) Name() string   { return v.name }
 
-func BackupViews(src *exasol.Conn, dst string, crit Criteria, maxRows int, dropExtras bool) error {
+func BackupViews(src *exasol.Conn, dst string, crit Criteria, data DataConf, dropExtras bool) error {
 	log.Info("Backing up views")
+	run := crit.state()
 
 	views, dbObjs, err := getViewsToBackup(src, crit)
 	if err != nil {
 		return err
 	}
 	if dropExtras {
-		removeExtraObjects("views", dbObjs, dst, crit)
+		err = removeExtraObjects("views", dbObjs, dst, crit)
+		if err != nil {
+			return err
+		}
+	}
+	selected := map[string]bool{}
+	for _, v := range views {
+		selected[v.schema+"."+v.name] = true
 	}
+	run.manifest.resetData("views", crit, dbObjs, selected)
 	if len(views) == 0 {
 		log.Warning("Object criteria did not match any views")
 		return nil
@@ -38,29 +45,50 @@ func BackupViews(src *exasol.Conn, dst string, crit Criteria, maxRows int, dropE
 
 	for _, v := range views {
 		dir := filepath.Join(dst, "schemas", v.schema, "views")
-		os.MkdirAll(dir, os.ModePerm)
-		err = backupView(dir, v)
+		run.makeDir(dir)
+		err = backupView(dir, v, run)
+		if err != nil {
+			return err
+		}
+		shouldBackup, err := shouldBackupViewData(src, v, data)
 		if err != nil {
 			return err
 		}
-		shouldBackup, err := shouldBackupViewData(src, v, maxRows)
+		fileName := ""
+		if shouldBackup {
+			fileName = v.name + ".csv"
+		}
+		// Make sure no outdated data is left next to the current DDL
+		err = retireDataFiles(dir, v.name, fileName, dropExtras, run)
 		if err != nil {
 			return err
 		}
 		if shouldBackup {
 			log.Infof("Backing up view data for %s.%s", v.schema, v.name)
+			format := data.csvFormat(v.schema, v.name)
+			selectList, masked, err := viewSelectList(src, v, data)
+			if err != nil {
+				return err
+			}
 			wg := &sync.WaitGroup{}
 			wg.Add(2)
-			data := make(chan []byte)
+			rows := make(chan []byte)
 			errors := make(chan error, 2)
-			go readViewData(src, v, data, errors, wg)
-			go writeViewData(dir, v, data, errors, wg)
+			go readViewData(src, v, selectList, format, rows, errors, wg, run)
+			go writeViewData(dir, v, rows, errors, wg, run)
 			wg.Wait()
 			select {
 			case err = <-errors:
 				return err
 			default:
 			}
+			run.manifest.addData("views", &dataEntry{
+				Schema: v.schema,
+				Name:   v.name,
+				File:   filepath.Join("schemas", v.schema, "views", v.name+".csv"),
+				Format: format,
+				Masked: masked,
+			})
 		}
 	}
 
@@ -86,6 +114,15 @@ func getViewsToBackup(conn *exasol.Conn, crit Criteria) ([]*view, []dbObj, error
 	if err != nil {
 		return nil, nil, fmt.Errorf("Unable to get views: %s", err)
 	}
+	skipped, err := getSkippedSchemas(conn)
+	if err != nil {
+		return nil, nil, err
+	}
+	filter := crit.state().objectFilter
+	err = filter.load(conn, "views", crit)
+	if err != nil {
+		return nil, nil, err
+	}
 	views := []*view{}
 	dbObjs := []dbObj{}
 	for _, row := range res {
@@ -99,13 +136,15 @@ func getViewsToBackup(conn *exasol.Conn, crit Criteria) ([]*view, []dbObj, error
 		} else {
 			v.scope = row[2].(string)
 		}
-		views = append(views, v)
 		dbObjs = append(dbObjs, v)
+		if !skipped[v.schema] && !filter.excludes("views", v.schema, v.name) {
+			views = append(views, v)
+		}
 	}
 	return views, dbObjs, nil
 }
 
-func backupView(dir string, v *view) error {
+func backupView(dir string, v *view, run *backupRun) error {
 	log.Infof("Backing up view %s.%s", v.schema, v.name)
 
 	// We have to swap out the name too because if the view got renamed
@@ -117,15 +156,16 @@ func backupView(dir string, v *view) error {
 	sql := fmt.Sprintf("OPEN SCHEMA [%s];\n%s;\n", v.scope, createView)
 	file := filepath.Join(dir, v.name+".sql")
 
-	err := ioutil.WriteFile(file, []byte(sql), 0644)
+	err := run.writeFile(file, []byte(sql), "views")
 	if err != nil {
 		return fmt.Errorf("Unable to backup view %s: %s", v.name, err)
 	}
 	return nil
 }
 
-func shouldBackupViewData(conn *exasol.Conn, v *view, maxRows int) (bool, error) {
-	if maxRows == 0 {
+func shouldBackupViewData(conn *exasol.Conn, v *view, data DataConf) (bool, error) {
+	always := data.matches(v.schema, v.name)
+	if data.MaxRows == 0 && !always {
 		return false, nil
 	}
 	sql := fmt.Sprintf(`SELECT COUNT(*) FROM [%s].[%s]`, v.schema, v.name)
@@ -134,18 +174,46 @@ func shouldBackupViewData(conn *exasol.Conn, v *view, maxRows int) (bool, error)
 		return false, fmt.Errorf("Unable to number of view rows: %s", err)
 	}
 	numRows := int(res[0][0].(float64))
-	return numRows > 0 && numRows <= maxRows, nil
+	return numRows > 0 && (always || numRows <= data.MaxRows), nil
 }
 
-func readViewData(conn *exasol.Conn, v *view, data chan<- []byte, errors chan<- error, wg *sync.WaitGroup) {
+func viewSelectList(conn *exasol.Conn, v *view, data DataConf) (string, map[string]string, error) {
+	sql := fmt.Sprintf(`
+		SELECT column_name, column_type, column_num_scale
+		FROM exa_all_columns
+		WHERE column_object_type = 'VIEW'
+		  AND column_schema = '%s'
+		  AND column_table = '%s'
+		ORDER BY column_ordinal_position
+		`, qStr(v.schema), qStr(v.name),
+	)
+	res, err := conn.FetchSlice(sql)
+	if err != nil {
+		return "", nil, fmt.Errorf("Unable to get view columns: %s", err)
+	}
+	var cols []*column
+	for _, row := range res {
+		cols = append(cols, &column{
+			name:    row[0].(string),
+			colType: row[1].(string),
+			scale:   timestampScale(row[2]),
+		})
+	}
+	return data.selectList(v.schema, v.name, cols)
+}
+
+func readViewData(conn *exasol.Conn, v *view, selectList string, format CSVFormat, data chan<- []byte, errors chan<- error, wg *sync.WaitGroup, run *backupRun) {
 	defer func() {
 		close(data)
 		wg.Done()
 	}()
 
+	if run.dryRun != nil {
+		return // Nothing is exported
+	}
 	exportSQL := fmt.Sprintf(
-		"EXPORT (SELECT * FROM [%s].[%s]) INTO CSV AT '%%s' FILE 'data.csv'",
-		v.schema, v.name,
+		"EXPORT (SELECT %s FROM [%s].[%s]) INTO CSV AT '%%s' FILE 'data.csv'%s",
+		selectList, qExportIdent(v.schema), qExportIdent(v.name), format.exportOptions(),
 	)
 	res := conn.StreamQuery(exportSQL)
 	if res.Error != nil {
@@ -157,20 +225,10 @@ func readViewData(conn *exasol.Conn, v *view, data chan<- []byte, errors chan<-
 	}
 }
 
-func writeViewData(dst string, v *view, data <-chan []byte, errors chan<- error, wg *sync.WaitGroup) {
+func writeViewData(dst string, v *view, data <-chan []byte, errors chan<- error, wg *sync.WaitGroup, run *backupRun) {
 	defer func() { wg.Done() }()
-	fp := filepath.Join(dst, v.name+".csv")
-	f, err := os.Create(fp)
+	err := run.writeDataFile(filepath.Join(dst, v.name+".csv"), data, "views")
 	if err != nil {
-		errors <- fmt.Errorf("Unable to create view file %s: %s", fp, err)
-		return
-	}
-	for d := range data {
-		_, err = f.Write(d)
-		if err != nil {
-			errors <- fmt.Errorf("Unable to write view file %s: %s", fp, err)
-			return
-		}
+		errors <- err
 	}
-	f.Close()
 }
@@ -2,8 +2,6 @@ package backup
 
 import (
 	"fmt"
-	"io/ioutil"
-	"os"
 	"path/filepath"
 	"strings"
 
@@ -30,13 +28,17 @@ func (s *virtual_schema) Name() string   { return "" }
 
 func BackupVirtualSchemas(src *exasol.Conn, dst string, crit Criteria, dropExtras bool) error {
 	log.Infof("Backing up schemas")
+	run := crit.state()
 
 	schemas, dbObjs, err := getVirtualSchemasToBackup(src, crit)
 	if err != nil {
 		return err
 	}
 	if dropExtras {
-		removeExtraObjects("virtual_schemas", dbObjs, dst, crit)
+		err = removeExtraObjects("virtual_schemas", dbObjs, dst, crit)
+		if err != nil {
+			return err
+		}
 	}
 
 	if len(schemas) == 0 {
@@ -50,9 +52,9 @@ func BackupVirtualSchemas(src *exasol.Conn, dst string, crit Criteria, dropExtra
 	}
 
 	dir := filepath.Join(dst, "schemas")
-	os.MkdirAll(dir, os.ModePerm)
+	run.makeDir(dir)
 	for _, schema := range schemas {
-		err = createVirtualSchema(dir, schema)
+		err = createVirtualSchema(dir, schema, run)
 		if err != nil {
 			return err
 		}
@@ -140,7 +142,7 @@ func addVirtualSchemaProps(conn *exasol.Conn, schemas []*virtual_schema, crit Cr
 	return nil
 }
 
-func createVirtualSchema(dst string, s *virtual_schema) error {
+func createVirtualSchema(dst string, s *virtual_schema, run *backupRun) error {
 	log.Infof("Backing up virtual schema %s", s.name)
 	props := ""
 	if len(s.vSchemaProps) > 0 {
@@ -160,10 +162,10 @@ func createVirtualSchema(dst string, s *virtual_schema) error {
 	}
 
 	dir := filepath.Join(dst, s.name)
-	os.MkdirAll(dir, os.ModePerm)
+	run.makeDir(dir)
 
 	file := filepath.Join(dir, "schema.sql")
-	err := ioutil.WriteFile(file, []byte(sql), 0644)
+	err := run.writeFile(file, []byte(sql), "virtual_schemas")
 	if err != nil {
 		return fmt.Errorf("Unable to backup virtual schema: %s", err)
 	}